@@ -0,0 +1,36 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"sync/atomic"
+)
+
+// An atomicValue is a setting of type T which is replaced while messages are
+// being logged.  The zero value holds the zero value of T.
+//
+// The values are boxed because atomic.Value requires every value stored in it
+// to have the same concrete type and not to be nil, which nil pointers and
+// interfaces such as Formatter holding different types would break.
+type atomicValue[T any] struct {
+	v atomic.Value // box[T]
+}
+
+type box[T any] struct {
+	v T
+}
+
+func (a *atomicValue[T]) Load() T {
+	b, _ := a.v.Load().(box[T])
+	return b.v
+}
+
+func (a *atomicValue[T]) Store(v T) {
+	a.v.Store(box[T]{v})
+}
+
+// Swap stores v and returns the previous value.
+func (a *atomicValue[T]) Swap(v T) T {
+	b, _ := a.v.Swap(box[T]{v}).(box[T])
+	return b.v
+}
@@ -0,0 +1,203 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Sentinels for a threshold which is not set (and so admits every level, or is
+// inherited by a named logger) and for the minimum level of a logger which has
+// no filters to write to.
+const (
+	noThreshold = math.MinInt32
+	noLevel     = math.MaxInt32
+)
+
+// A hierarchy is the tree of named loggers rooted at a logger created with
+// NewLogger.  Log calls take the filters they write to under the read lock and
+// write to them once it is unlocked, so that a slow writer does not hold up
+// changes to the filters; closing a filter removed under the write lock waits
+// for the writes started before.  The lock guards the filters and additivity
+// of every category.
+type hierarchy struct {
+	mu         sync.RWMutex
+	categories map[string]*category // by name; the root is ""
+
+	vmodule atomicValue[*vmodule]     // replaced under the write lock
+	handler atomicValue[ErrorHandler] // see Logger.SetErrorHandler; replaced under the write lock
+
+	envReported bool // whether VModuleEnvError was passed to a handler; guarded by mu
+}
+
+// A category holds the filters and settings of one named logger, shared with
+// the children created from it with With.
+type category struct {
+	hier     *hierarchy
+	name     string
+	parent   *category
+	filters  map[string]*Filter
+	additive bool
+
+	// The threshold set on the category, the effective threshold (its own or
+	// its nearest ancestor's) and the lowest level any reachable filter would
+	// write, which is never below the effective threshold.  The minimum level
+	// also takes the per-source overrides into account and lets log calls
+	// skip disabled levels without taking the lock; the base level does not.
+	// All are updated under the write lock and read atomically.
+	threshold int32
+	effective int32
+	baseLevel int32
+	minLevel  int32
+
+	// The stack trace settings of the category, if any, and the effective
+	// ones (its own or its nearest ancestor's), updated like the levels.
+	stack    *StackTrace
+	effStack atomicValue[*StackTrace]
+}
+
+func newHierarchy() *category {
+	hier := &hierarchy{categories: make(map[string]*category)}
+	hier.vmodule.Store(vmoduleFromEnv())
+	root := hier.newCategory("", nil)
+	hier.updateLevels()
+	return root
+}
+
+// Must be called with mu held for writing.
+func (hier *hierarchy) newCategory(name string, parent *category) *category {
+	cat := &category{
+		hier:      hier,
+		name:      name,
+		parent:    parent,
+		filters:   make(map[string]*Filter),
+		additive:  true,
+		threshold: noThreshold,
+	}
+	hier.categories[name] = cat
+	return cat
+}
+
+// Recompute the cached levels of every category.  Must be called with mu held
+// for writing.
+func (hier *hierarchy) updateLevels() {
+	vm := hier.vmodule.Load()
+	for _, cat := range hier.categories {
+		effective := int32(noThreshold)
+		for c := cat; c != nil; c = c.parent {
+			if lvl := atomic.LoadInt32(&c.threshold); lvl != noThreshold {
+				effective = lvl
+				break
+			}
+		}
+
+		min := int32(noLevel)
+		for c := cat; c != nil; c = c.parent {
+			for _, filt := range c.filters {
+				if lvl := atomic.LoadInt32(&filt.level); lvl < min {
+					min = lvl
+				}
+			}
+			if !c.additive {
+				break
+			}
+		}
+		if min < effective {
+			min = effective
+		}
+		base := min
+
+		// Overrides can send records below the base level to any filter
+		if vm != nil && min != noLevel && int32(vm.min) < min {
+			min = int32(vm.min)
+		}
+
+		atomic.StoreInt32(&cat.effective, effective)
+		atomic.StoreInt32(&cat.baseLevel, base)
+		atomic.StoreInt32(&cat.minLevel, min)
+
+		var st *StackTrace
+		for c := cat; c != nil && st == nil; c = c.parent {
+			st = c.stack
+		}
+		cat.effStack.Store(st)
+	}
+}
+
+// GetLogger returns the named logger from the hierarchy of log, creating it
+// (and any missing ancestors) if necessary.  Names are dot-separated paths, so
+// the parent of "app.db.pool" is "app.db", whose parent is "app", whose parent
+// is the root logger of the hierarchy.  Empty parts are dropped, so "app..db"
+// and ".app.db." name "app.db".
+//
+// A named logger starts with no filters and no threshold of its own: it uses
+// the threshold of its nearest ancestor which has one and, while it is
+// additive, writes its records to the filters of its ancestors as well.  The
+// root logger has the empty name.
+func (log *Logger) GetLogger(name string) *Logger {
+	name = normalizeLoggerName(name)
+	hier := log.cat.hier
+	hier.mu.RLock()
+	cat, ok := hier.categories[name]
+	hier.mu.RUnlock()
+	if ok {
+		return &Logger{cat: cat}
+	}
+
+	hier.mu.Lock()
+	defer hier.mu.Unlock()
+	parent := hier.categories[""]
+	for i := 0; i <= len(name); i++ {
+		if i < len(name) && name[i] != '.' {
+			continue
+		}
+		prefix := name[:i]
+		cat, ok = hier.categories[prefix]
+		if !ok {
+			cat = hier.newCategory(prefix, parent)
+		}
+		parent = cat
+	}
+	hier.updateLevels()
+	return &Logger{cat: cat}
+}
+
+// Name returns the name of the logger; the root logger has the empty name.
+func (log *Logger) Name() string {
+	return log.cat.name
+}
+
+// SetAdditivity controls whether records logged to the logger are also written
+// to the filters of its parent.  Loggers are additive by default.
+func (log *Logger) SetAdditivity(additive bool) {
+	hier := log.cat.hier
+	hier.mu.Lock()
+	defer hier.mu.Unlock()
+	log.cat.additive = additive
+	hier.updateLevels()
+}
+
+// Additivity reports whether records logged to the logger are also written to
+// the filters of its parent.
+func (log *Logger) Additivity() bool {
+	log.cat.hier.mu.RLock()
+	defer log.cat.hier.mu.RUnlock()
+	return log.cat.additive
+}
+
+// Return name without empty parts, as GetLogger takes it
+func normalizeLoggerName(name string) string {
+	if !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, ".") && !strings.Contains(name, "..") {
+		return name
+	}
+	var parts []string
+	for _, part := range strings.Split(name, ".") {
+		if len(part) > 0 {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,134 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A ColorMode says when a ConsoleLogWriter colors the records it writes.
+type ColorMode int
+
+const (
+	ColorNever  ColorMode = iota // Never color records
+	ColorAuto                    // Color records when writing to a terminal, unless NO_COLOR is set
+	ColorAlways                  // Color records wherever they are written
+)
+
+var colorModeNames = [...]string{"never", "auto", "always"}
+
+func (m ColorMode) String() string {
+	if m >= 0 && int(m) < len(colorModeNames) {
+		return colorModeNames[m]
+	}
+	return fmt.Sprintf("ColorMode(%d)", int(m))
+}
+
+// A Palette maps levels to the parameters of the ANSI escape sequences
+// (SGR) which color them, such as "31" for red or "1;31" for bold red.
+// Levels which are not in the palette are not colored.
+type Palette map[Level]string
+
+// DefaultPalette is the palette of writers which are not given one.
+var DefaultPalette = Palette{
+	FINEST:   "90",
+	FINE:     "90",
+	DEBUG:    "36",
+	TRACE:    "34",
+	INFO:     "32",
+	WARNING:  "33",
+	ERROR:    "31",
+	CRITICAL: "1;31",
+}
+
+// Colors configures the colors of a ConsoleLogWriter (see SetColors).
+type Colors struct {
+	Mode    ColorMode
+	Palette Palette // nil means DefaultPalette
+
+	// Verbs are the verbs of a PatternFormatter which are colored, such as
+	// "LM" for the level and the message; empty means the whole record.
+	// Records formatted by other formatters are not colored.
+	Verbs string
+}
+
+// How a writer colors records: nil if it does not
+type painter struct {
+	palette Palette
+	verbs   string
+}
+
+// Return how to color records written to out, or nil if they are not colored
+func newPainter(colors Colors, out io.Writer) *painter {
+	switch colors.Mode {
+	case ColorAlways:
+	case ColorAuto:
+		if len(os.Getenv("NO_COLOR")) > 0 || !isTerminal(out) {
+			return nil
+		}
+	default:
+		return nil
+	}
+	p := &painter{palette: colors.Palette, verbs: colors.Verbs}
+	if p.palette == nil {
+		p.palette = DefaultPalette
+	}
+	return p
+}
+
+// Report whether out is a terminal (or another character device)
+func isTerminal(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Append the escape sequence which starts the color with the given parameters
+func appendColor(buf []byte, color string) []byte {
+	buf = append(buf, "\x1b["...)
+	buf = append(buf, color...)
+	return append(buf, 'm')
+}
+
+// Ends a color
+const colorReset = "\x1b[0m"
+
+// ParsePalette parses a palette from a list of level=color pairs separated by
+// commas, such as "INFO=32,ERROR=1;31", where the levels are as ParseLevel
+// takes them and an empty color leaves a level uncolored.  Levels which are not
+// listed keep their colors in DefaultPalette.
+func ParsePalette(s string) (Palette, error) {
+	palette := make(Palette, len(DefaultPalette))
+	for lvl, color := range DefaultPalette {
+		palette[lvl] = color
+	}
+	for _, pair := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+		eq := strings.IndexByte(pair, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("log4go: palette entry %q is not level=color", pair)
+		}
+		lvl, err := ParseLevel(pair[:eq])
+		if err != nil {
+			return nil, err
+		}
+		color := strings.TrimSpace(pair[eq+1:])
+		if strings.Trim(color, "0123456789;") != "" {
+			return nil, fmt.Errorf("log4go: color %q of %s is not a list of numbers separated by semicolons", color, lvl.Name())
+		}
+		if len(color) == 0 {
+			delete(palette, lvl)
+			continue
+		}
+		palette[lvl] = color
+	}
+	return palette, nil
+}
@@ -4,11 +4,13 @@ package log4go
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type xmlProperty struct {
@@ -17,19 +19,69 @@ type xmlProperty struct {
 }
 
 type xmlFilter struct {
-	Enabled  string        `xml:"enabled,attr"`
-	Tag      string        `xml:"tag"`
-	Level    string        `xml:"level"`
-	Type     string        `xml:"type"`
-	Property []xmlProperty `xml:"property"`
+	Enabled   string        `xml:"enabled,attr"`
+	Tag       string        `xml:"tag"`
+	Level     string        `xml:"level"`
+	Type      string        `xml:"type"`
+	Property  []xmlProperty `xml:"property"`
+	Limit     *xmlLimit     `xml:"limit"`
+	Dedup     *xmlDedup     `xml:"dedup"`
+	Overflow  *xmlOverflow  `xml:"overflow"`
+	Formatter *xmlFormatter `xml:"formatter"`
+}
+
+type xmlFormatter struct {
+	Type     string `xml:"type,attr"`
+	Format   string `xml:"format,attr"`
+	Location string `xml:"location,attr"`
+
+	// Attributes of json formatters
+	TimeKey    string `xml:"time-key,attr"`
+	LevelKey   string `xml:"level-key,attr"`
+	MessageKey string `xml:"message-key,attr"`
+	SourceKey  string `xml:"source-key,attr"`
+	LoggerKey  string `xml:"logger-key,attr"`
+	FieldsKey  string `xml:"fields-key,attr"`
+	TimeLayout string `xml:"time-layout,attr"`
+	LevelStyle string `xml:"level-style,attr"`
+	Flatten    string `xml:"flatten,attr"`
+}
+
+type xmlOverflow struct {
+	Policy     string `xml:"policy,attr"`
+	Timeout    string `xml:"timeout,attr"`
+	Level      string `xml:"level,attr"`
+	ReportLoss string `xml:"report-loss,attr"`
+}
+
+type xmlDedup struct {
+	Window string `xml:"window,attr"`
+}
+
+type xmlLimit struct {
+	SampleInterval string `xml:"sample-interval,attr"`
+	First          string `xml:"first,attr"`
+	Thereafter     string `xml:"thereafter,attr"`
+	Rate           string `xml:"rate,attr"`
+	Burst          string `xml:"burst,attr"`
+	Report         string `xml:"report,attr"`
+}
+
+type xmlLogger struct {
+	Name       string   `xml:"name,attr"`
+	Level      string   `xml:"level,attr"`
+	Additivity string   `xml:"additivity,attr"`
+	FilterRef  []string `xml:"filter-ref"`
 }
 
 type xmlLoggerConfig struct {
-	Filter []xmlFilter `xml:"filter"`
+	Filter  []xmlFilter `xml:"filter"`
+	Logger  []xmlLogger `xml:"logger"`
+	VModule string      `xml:"vmodule"`
 }
 
 // Load XML configuration; see examples/example.xml for documentation
-func (log Logger) LoadConfiguration(filename string) {
+func (log *Logger) LoadConfiguration(filename string) {
 	log.Close()
 
 	// Open the configuration file
@@ -51,9 +103,24 @@ func (log Logger) LoadConfiguration(filename string) {
 		os.Exit(1)
 	}
 
+	// Without <vmodule>, the rules of an earlier configuration are removed
+	if err := log.SetVModule(xc.VModule); err != nil {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not parse <vmodule> in %s: %s\n", filename, err)
+		os.Exit(1)
+	}
+
+	// Filters referenced by a named logger are only added to that logger
+	referenced := make(map[string]bool)
+	for _, xmllog := range xc.Logger {
+		for _, tag := range xmllog.FilterRef {
+			referenced[strings.TrimSpace(tag)] = true
+		}
+	}
+	filters := make(map[string]*Filter)
+	known := make(map[string]bool)
+
 	for _, xmlfilt := range xc.Filter {
 		var filt LogWriter
-		var lvl Level
 		bad, good, enabled := false, true, false
 
 		// Check required children
@@ -76,28 +143,41 @@ func (log Logger) LoadConfiguration(filename string) {
 			bad = true
 		}
 
-		switch xmlfilt.Level {
-		case "FINEST":
-			lvl = FINEST
-		case "FINE":
-			lvl = FINE
-		case "DEBUG":
-			lvl = DEBUG
-		case "TRACE":
-			lvl = TRACE
-		case "INFO":
-			lvl = INFO
-		case "WARNING":
-			lvl = WARNING
-		case "ERROR":
-			lvl = ERROR
-		case "CRITICAL":
-			lvl = CRITICAL
-		default:
+		lvl, err := ParseLevel(xmlfilt.Level)
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required child <%s> for filter has unknown value in %s: %s\n", "level", filename, xmlfilt.Level)
 			bad = true
 		}
 
+		var limits *Limits
+		if xmlfilt.Limit != nil {
+			if limits, good = xmlToLimits(filename, xmlfilt.Limit); !good {
+				bad = true
+			}
+		}
+
+		var overflow *Overflow
+		if xmlfilt.Overflow != nil {
+			if overflow, good = xmlToOverflow(filename, xmlfilt.Overflow); !good {
+				bad = true
+			}
+		}
+
+		var formatter Formatter
+		if xmlfilt.Formatter != nil {
+			if formatter, good = xmlToFormatter(filename, xmlfilt.Formatter); !good {
+				bad = true
+			}
+		}
+
+		var window time.Duration
+		if xmlfilt.Dedup != nil {
+			if window, err = time.ParseDuration(strings.TrimSpace(xmlfilt.Dedup.Window)); err != nil || window <= 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Attribute %s for dedup has invalid value in %s: %s\n", "window", filename, xmlfilt.Dedup.Window)
+				bad = true
+			}
+		}
+
 		// Just so all of the required attributes are errored at the same time if missing
 		if bad {
 			os.Exit(1)
@@ -122,30 +202,305 @@ func (log Logger) LoadConfiguration(filename string) {
 			os.Exit(1)
 		}
 
+		known[xmlfilt.Tag] = true
+
 		// If we're disabled (syntax and correctness checks only), don't add to logger
 		if !enabled {
 			continue
 		}
 
-		log[xmlfilt.Tag] = &Filter{lvl, filt}
+		// The writer could not be created, and has reported why
+		if filt == nil {
+			continue
+		}
+
+		if formatter != nil {
+			switch w := filt.(type) {
+			case *FileLogWriter:
+				w.SetFormatter(formatter)
+			case interface{ SetFormatter(Formatter) }:
+				w.SetFormatter(formatter)
+			default:
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Filter %q of type %s has no formatter to set <formatter> for in %s\n", xmlfilt.Tag, xmlfilt.Type, filename)
+			}
+		}
+		if overflow != nil {
+			if q, ok := filt.(interface{ SetOverflow(Overflow) }); ok {
+				q.SetOverflow(*overflow)
+			} else {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Filter %q of type %s has no queue to set <overflow> for in %s\n", xmlfilt.Tag, xmlfilt.Type, filename)
+			}
+		}
+		if window > 0 {
+			filt = NewDedupLogWriter(filt, window)
+		}
+		filters[xmlfilt.Tag] = &Filter{level: int32(lvl), LogWriter: filt}
+		if limits != nil {
+			filters[xmlfilt.Tag].SetLimits(limits)
+		}
+		if !referenced[xmlfilt.Tag] {
+			log.replaceFilter(xmlfilt.Tag, filters[xmlfilt.Tag])
+		}
+	}
+
+	for _, xmllog := range xc.Logger {
+		bad := false
+
+		// The root logger has the empty name, and is configured by the filters
+		if len(normalizeLoggerName(xmllog.Name)) == 0 {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid attribute %s=%q for logger in %s\n", "name", xmllog.Name, filename)
+			bad = true
+		}
+		var lvl Level
+		if len(xmllog.Level) > 0 {
+			var err error
+			if lvl, err = ParseLevel(xmllog.Level); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Attribute %s for logger %q has unknown value in %s: %s\n", "level", xmllog.Name, filename, xmllog.Level)
+				bad = true
+			}
+		}
+		for _, tag := range xmllog.FilterRef {
+			if tag = strings.TrimSpace(tag); !known[tag] {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Logger %q references unknown filter %q in %s\n", xmllog.Name, tag, filename)
+				bad = true
+			}
+		}
+		if bad {
+			os.Exit(1)
+		}
+
+		named := log.GetLogger(xmllog.Name)
+		if len(xmllog.Level) > 0 {
+			named.SetThreshold(lvl)
+		}
+		named.SetAdditivity(xmllog.Additivity != "false")
+		for _, tag := range xmllog.FilterRef {
+			// References to disabled filters are checked but not added
+			if filt, ok := filters[strings.TrimSpace(tag)]; ok {
+				named.replaceFilter(strings.TrimSpace(tag), filt)
+			}
+		}
+	}
+}
+
+// Parse the attributes of a <limit> element
+func xmlToLimits(filename string, xmllim *xmlLimit) (*Limits, bool) {
+	limits := new(Limits)
+	good := true
+	parse := func(attr, value string, parse func(string) error) {
+		if value = strings.TrimSpace(value); len(value) == 0 {
+			return
+		}
+		if err := parse(value); err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Attribute %s for limit has invalid value in %s: %s\n", attr, filename, value)
+			good = false
+		}
 	}
+	duration := func(d *time.Duration) func(string) error {
+		return func(value string) (err error) {
+			if *d, err = time.ParseDuration(value); err == nil && *d < 0 {
+				err = errNegative
+			}
+			return err
+		}
+	}
+	count := func(n *int) func(string) error {
+		return func(value string) (err error) {
+			if *n, err = strconv.Atoi(value); err == nil && *n < 0 {
+				err = errNegative
+			}
+			return err
+		}
+	}
+
+	parse("sample-interval", xmllim.SampleInterval, duration(&limits.SampleInterval))
+	parse("first", xmllim.First, count(&limits.SampleFirst))
+	parse("thereafter", xmllim.Thereafter, count(&limits.SampleThereafter))
+	parse("rate", xmllim.Rate, func(value string) (err error) {
+		if limits.Rate, err = strconv.ParseFloat(value, 64); err == nil && limits.Rate < 0 {
+			err = errNegative
+		}
+		return err
+	})
+	parse("burst", xmllim.Burst, count(&limits.Burst))
+	parse("report", xmllim.Report, duration(&limits.ReportInterval))
+	return limits, good
+}
+
+var errNegative = errors.New("negative value")
+
+// Parse the attributes of a <formatter> element
+func xmlToFormatter(filename string, xmlfmt *xmlFormatter) (Formatter, bool) {
+	switch strings.TrimSpace(xmlfmt.Type) {
+	case "pattern":
+		f, err := CompileFormat(xmlfmt.Format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Attribute %s for formatter has invalid value in %s: %s\n", "format", filename, err)
+			return nil, false
+		}
+		if name := strings.TrimSpace(xmlfmt.Location); len(name) > 0 {
+			loc, err := time.LoadLocation(name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Attribute %s for formatter has invalid value in %s: %s\n", "location", filename, err)
+				return nil, false
+			}
+			f = f.In(loc)
+		}
+		return f, true
+	case "json":
+		return xmlToJSONFormatter(filename, xmlfmt)
+	case "xml":
+		return XMLFormatter{}, true
+	case "logfmt":
+		return LogfmtFormatter{}, true
+	}
+	fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Attribute %s for formatter has unknown value in %s: %s\n", "type", filename, xmlfmt.Type)
+	return nil, false
+}
+
+// Parse the attributes of a json <formatter> element
+func xmlToJSONFormatter(filename string, xmlfmt *xmlFormatter) (Formatter, bool) {
+	f := JSONFormatter{
+		TimeKey:    strings.TrimSpace(xmlfmt.TimeKey),
+		LevelKey:   strings.TrimSpace(xmlfmt.LevelKey),
+		MessageKey: strings.TrimSpace(xmlfmt.MessageKey),
+		SourceKey:  strings.TrimSpace(xmlfmt.SourceKey),
+		LoggerKey:  strings.TrimSpace(xmlfmt.LoggerKey),
+		FieldsKey:  strings.TrimSpace(xmlfmt.FieldsKey),
+	}
+	good := true
+	f.TimeLayout = xmlfmt.TimeLayout
+	if layout, ok := TimeLayouts[strings.TrimSpace(xmlfmt.TimeLayout)]; ok {
+		f.TimeLayout = layout
+	}
+	switch strings.TrimSpace(xmlfmt.LevelStyle) {
+	case "", "name":
+		f.LevelStyle = LevelName
+	case "short":
+		f.LevelStyle = LevelShort
+	case "number":
+		f.LevelStyle = LevelNumber
+	default:
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Attribute %s for formatter has unknown value in %s: %s\n", "level-style", filename, xmlfmt.LevelStyle)
+		good = false
+	}
+	switch strings.TrimSpace(xmlfmt.Flatten) {
+	case "", "false":
+	case "true":
+		f.FlattenFields = true
+	default:
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Attribute %s for formatter has invalid value in %s: %s\n", "flatten", filename, xmlfmt.Flatten)
+		good = false
+	}
+	return f, good
+}
+
+// Parse the attributes of an <overflow> element
+func xmlToOverflow(filename string, xmlover *xmlOverflow) (*Overflow, bool) {
+	overflow := new(Overflow)
+	good := false
+	policy := strings.TrimSpace(xmlover.Policy)
+	for i, name := range overflowPolicyNames {
+		if policy == name {
+			overflow.Policy, good = OverflowPolicy(i), true
+		}
+	}
+	if !good {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Attribute %s for overflow has unknown value in %s: %s\n", "policy", filename, xmlover.Policy)
+	}
+	if timeout := strings.TrimSpace(xmlover.Timeout); len(timeout) > 0 {
+		var err error
+		if overflow.Timeout, err = time.ParseDuration(timeout); err != nil || overflow.Timeout < 0 {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Attribute %s for overflow has invalid value in %s: %s\n", "timeout", filename, xmlover.Timeout)
+			good = false
+		}
+	}
+	if lvl := strings.TrimSpace(xmlover.Level); len(lvl) > 0 {
+		var err error
+		if overflow.Level, err = ParseLevel(lvl); err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Attribute %s for overflow has unknown value in %s: %s\n", "level", filename, xmlover.Level)
+			good = false
+		}
+	}
+	overflow.ReportLoss = strings.TrimSpace(xmlover.ReportLoss) == "true"
+	return overflow, good
 }
 
 func xmlToConsoleLogWriter(filename string, props []xmlProperty, enabled bool) (*ConsoleLogWriter, bool) {
+	var colors Colors
+	var opts ConsoleOptions
+	good := true
+
 	// Parse properties
 	for _, prop := range props {
 		switch prop.Name {
+		case "color":
+			mode := strings.TrimSpace(prop.Value)
+			found := false
+			for i, name := range colorModeNames {
+				if mode == name {
+					colors.Mode, found = ColorMode(i), true
+				}
+			}
+			if !found {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid property \"%s\" for console filter in %s: %s\n", prop.Name, filename, prop.Value)
+				good = false
+			}
+		case "palette":
+			palette, err := ParsePalette(prop.Value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid property \"%s\" for console filter in %s: %s\n", prop.Name, filename, err)
+				good = false
+			}
+			colors.Palette = palette
+		case "colorverbs":
+			verbs := strings.TrimSpace(prop.Value)
+			for i := 0; i < len(verbs); i++ {
+				if strings.IndexByte(formatVerbs, verbs[i]) < 0 {
+					fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid property \"%s\" for console filter in %s: unknown verb %c\n", prop.Name, filename, verbs[i])
+					good = false
+				}
+			}
+			colors.Verbs = verbs
+		case "target":
+			target := strings.TrimSpace(prop.Value)
+			found := false
+			for i, name := range consoleTargetNames {
+				if target == name {
+					opts.Target, found = ConsoleTarget(i), true
+				}
+			}
+			if !found {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid property \"%s\" for console filter in %s: %s\n", prop.Name, filename, prop.Value)
+				good = false
+			}
+		case "splitlevel":
+			lvl, err := ParseLevel(prop.Value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid property \"%s\" for console filter in %s: %s\n", prop.Name, filename, err)
+				good = false
+			}
+			opts.SplitLevel, opts.SplitLevelSet = lvl, true
+		case "sync":
+			sync, err := strconv.ParseBool(strings.Trim(prop.Value, " \r\n"))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid property \"%s\" for console filter in %s: %s\n", prop.Name, filename, prop.Value)
+				good = false
+			}
+			opts.Sync = sync
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for console filter in %s\n", prop.Name, filename)
 		}
 	}
 
 	// If it's disabled, we're just checking syntax
-	if !enabled {
-		return nil, true
+	if !enabled || !good {
+		return nil, good
 	}
 
-	return NewConsoleLogWriter(), true
+	clw := NewConsoleLogWriterWith(opts)
+	clw.SetColors(colors)
+	return clw, true
 }
 
 // Parse a number with K/M/G suffixes based on thousands (1000) or 2^10 (1024)
@@ -219,6 +574,10 @@ func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*Fi
 		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for file filter missing in %s\n", "filename", filename)
 		return nil, false
 	}
+	if _, err := CompileFormat(format); err != nil {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid property \"%s\" for file filter in %s: %s\n", "format", filename, err)
+		return nil, false
+	}
 
 	// If it's disabled, we're just checking syntax
 	if !enabled {
@@ -289,7 +648,7 @@ func xmlToXMLLogWriter(filename string, props []xmlProperty, enabled bool) (*Fil
 	return xlw, true
 }
 
-func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (SocketLogWriter, bool) {
+func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (LogWriter, bool) {
 	endpoint := ""
 	protocol := "udp"
 
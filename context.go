@@ -0,0 +1,105 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+type contextKey int
+
+const (
+	fieldsContextKey contextKey = iota
+	traceContextKey
+)
+
+type traceContext struct {
+	traceID, spanID string
+}
+
+// ContextWithFields returns a copy of ctx carrying the given fields in addition
+// to any fields already attached to ctx.  Records logged with the *Ctx methods
+// include these fields.
+func ContextWithFields(ctx context.Context, fields ...Field) context.Context {
+	if len(fields) == 0 {
+		return ctx
+	}
+	parent := FieldsFromContext(ctx)
+	merged := make(Fields, 0, len(parent)+len(fields))
+	merged = append(merged, parent...)
+	merged = append(merged, fields...)
+	return context.WithValue(ctx, fieldsContextKey, merged)
+}
+
+// FieldsFromContext returns the fields attached to ctx by ContextWithFields.
+func FieldsFromContext(ctx context.Context) Fields {
+	if ctx == nil {
+		return nil
+	}
+	fields, _ := ctx.Value(fieldsContextKey).(Fields)
+	return fields
+}
+
+// ContextWithTrace returns a copy of ctx carrying the given trace and span IDs.
+// Records logged with the *Ctx methods store them in TraceID and SpanID.
+func ContextWithTrace(ctx context.Context, traceID, spanID string) context.Context {
+	return context.WithValue(ctx, traceContextKey, traceContext{traceID, spanID})
+}
+
+// ContextWithTraceParent parses a W3C traceparent header and returns a copy of
+// ctx carrying its trace and parent (span) IDs.
+func ContextWithTraceParent(ctx context.Context, traceparent string) (context.Context, error) {
+	traceID, spanID, err := ParseTraceParent(traceparent)
+	if err != nil {
+		return ctx, err
+	}
+	return ContextWithTrace(ctx, traceID, spanID), nil
+}
+
+// TraceFromContext returns the trace and span IDs attached to ctx, if any.
+func TraceFromContext(ctx context.Context) (traceID, spanID string) {
+	if ctx == nil {
+		return "", ""
+	}
+	tc, _ := ctx.Value(traceContextKey).(traceContext)
+	return tc.traceID, tc.spanID
+}
+
+var errTraceParent = errors.New("log4go: malformed traceparent")
+
+// ParseTraceParent extracts the trace ID and parent (span) ID from a W3C
+// traceparent header of the form "00-<32 hex digits>-<16 hex digits>-<2 hex digits>".
+func ParseTraceParent(traceparent string) (traceID, spanID string, err error) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 {
+		return "", "", errTraceParent
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	switch {
+	case !isLowerHex(version, 2) || version == "ff":
+		return "", "", errTraceParent
+	case version == "00" && len(parts) != 4:
+		return "", "", errTraceParent
+	case !isLowerHex(traceID, 32) || strings.Trim(traceID, "0") == "":
+		return "", "", errTraceParent
+	case !isLowerHex(spanID, 16) || strings.Trim(spanID, "0") == "":
+		return "", "", errTraceParent
+	case !isLowerHex(flags, 2):
+		return "", "", errTraceParent
+	}
+	return traceID, spanID, nil
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
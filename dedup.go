@@ -0,0 +1,127 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DedupLogWriter collapses runs of identical records (with the same level,
+// source and message) in front of another LogWriter, the way syslogd does.  The
+// first record of a run is written at once; the repeats which follow it within
+// the window are counted, and written as a single "last message repeated N
+// times" record when a different record arrives, when the window expires or
+// when the writer is closed.
+type DedupLogWriter struct {
+	w      LogWriter
+	window time.Duration
+
+	mu      sync.Mutex
+	last    *LogRecord // the first record of the current run
+	repeats int
+	run     int // counts runs, so a timer can tell whether its run has ended
+	timer   *time.Timer
+	closed  bool
+}
+
+// NewDedupLogWriter returns a writer which writes the records given to it to w,
+// collapsing runs of identical records no longer than window.
+func NewDedupLogWriter(w LogWriter, window time.Duration) *DedupLogWriter {
+	return &DedupLogWriter{w: w, window: window}
+}
+
+// LogWrite writes rec, unless it repeats the previous record within the window.
+func (d *DedupLogWriter) LogWrite(rec *LogRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+
+	if last := d.last; last != nil && rec.Created.Sub(last.Created) < d.window &&
+		rec.Level == last.Level && rec.Source == last.Source && rec.Message == last.Message {
+		d.repeats++
+		if d.timer == nil {
+			run := d.run
+			d.timer = time.AfterFunc(d.window-time.Since(last.Created), func() {
+				d.expire(run)
+			})
+		}
+		return
+	}
+
+	d.endRun()
+	d.last = rec
+	d.w.LogWrite(rec)
+}
+
+// Flush flushes the wrapped writer, if it is a Flusher.  A pending count of
+// repeats is written when the run ends, as usual.
+func (d *DedupLogWriter) Flush(ctx context.Context) error {
+	if f, ok := d.w.(Flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+// SetErrorHandler sets the error handler of the wrapped writer, if it is an
+// ErrorReporter.
+func (d *DedupLogWriter) SetErrorHandler(h ErrorHandler) {
+	if r, ok := d.w.(ErrorReporter); ok {
+		r.SetErrorHandler(h)
+	}
+}
+
+// Close writes the count of any pending repeats and closes the wrapped writer.
+func (d *DedupLogWriter) Close() {
+	d.CloseContext(context.Background())
+}
+
+// CloseContext closes the writer like Close, using the CloseContext method of
+// the wrapped writer if it is a ContextCloser.
+func (d *DedupLogWriter) CloseContext(ctx context.Context) error {
+	d.mu.Lock()
+	d.endRun()
+	d.closed = true
+	d.mu.Unlock()
+
+	if cc, ok := d.w.(ContextCloser); ok {
+		return cc.CloseContext(ctx)
+	}
+	d.w.Close()
+	return nil
+}
+
+// Called when the window of a run expires
+func (d *DedupLogWriter) expire(run int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed || run != d.run {
+		return
+	}
+	d.endRun()
+}
+
+// Write the count of repeats of the current run, if any, and start a new one.
+// Must be called with mu held.
+func (d *DedupLogWriter) endRun() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.repeats > 0 {
+		d.w.LogWrite(&LogRecord{
+			Level:    d.last.Level,
+			Created:  time.Now(),
+			Source:   d.last.Source,
+			Message:  fmt.Sprintf("last message repeated %d times", d.repeats),
+			Category: d.last.Category,
+		})
+	}
+	d.last = nil
+	d.repeats = 0
+	d.run++
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"os"
+)
+
+// A WriterError is a failure of a writer, such as a log file which cannot be
+// written to or a socket which was closed, as passed to an ErrorHandler.  The
+// writer carries on after reporting it, with the next record.
+type WriterError struct {
+	Tag    string // The name of the filter of the writer, if reported through a Logger
+	Writer string // The writer, such as FileLogWriter("app.log")
+	Op     string // What failed: "open", "dial", "format", "write", "rotate", "close" or "parse"
+	Err    error
+}
+
+func (e *WriterError) Error() string {
+	if len(e.Tag) > 0 {
+		return fmt.Sprintf("log4go: filter %q: %s: %s: %s", e.Tag, e.Writer, e.Op, e.Err)
+	}
+	return fmt.Sprintf("log4go: %s: %s: %s", e.Writer, e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *WriterError) Unwrap() error {
+	return e.Err
+}
+
+// An ErrorHandler is called with the failures of a writer (see SetErrorHandler
+// on the writers and on Logger).  It is called from the goroutine of the
+// writer, so it must not block for long, nor log to the same writer.
+type ErrorHandler func(err *WriterError)
+
+// DefaultErrorHandler handles the failures of writers which have no handler of
+// their own, and those of the constructors of writers, which return nil.  It
+// prints them to standard error.  It may be replaced before any writer is
+// created.
+var DefaultErrorHandler ErrorHandler = func(err *WriterError) {
+	fmt.Fprintln(os.Stderr, err)
+}
+
+// SetErrorHandler sets the function which the writer passes its failures to; a
+// nil handler restores DefaultErrorHandler.  It is safe to call while messages
+// are being logged.
+func (q *recordQueue) SetErrorHandler(h ErrorHandler) {
+	q.handler.Store(h)
+}
+
+// Pass err to the handler of the writer
+func (q *recordQueue) fail(err *WriterError) {
+	h := q.handler.Load()
+	if h == nil {
+		DefaultErrorHandler(err)
+		return
+	}
+	h(err)
+}
+
+// Returns a handler which passes errors on to h with the given filter name
+func tagErrors(tag string, h ErrorHandler) ErrorHandler {
+	return func(err *WriterError) {
+		tagged := *err
+		tagged.Tag = tag
+		h(&tagged)
+	}
+}
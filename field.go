@@ -0,0 +1,370 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// FieldType tells a writer how the value of a Field is stored.
+type FieldType uint8
+
+const (
+	AnyType FieldType = iota
+	StringType
+	IntType
+	UintType
+	FloatType
+	BoolType
+	DurationType
+	TimeType
+	ErrorType
+)
+
+// A Field is a typed key/value pair carried by a LogRecord.  Fields are built
+// with the String, Int, Bool, ... constructors (or Any) and attached to records
+// with Logger.With.
+type Field struct {
+	Key  string
+	Type FieldType
+
+	num   int64       // IntType, UintType, FloatType (bits), BoolType, DurationType
+	str   string      // StringType
+	iface interface{} // TimeType, ErrorType (errorValue), AnyType
+}
+
+// String constructs a field holding a string.
+func String(key, val string) Field {
+	return Field{Key: key, Type: StringType, str: val}
+}
+
+// Int constructs a field holding an int.
+func Int(key string, val int) Field {
+	return Int64(key, int64(val))
+}
+
+// Int64 constructs a field holding an int64.
+func Int64(key string, val int64) Field {
+	return Field{Key: key, Type: IntType, num: val}
+}
+
+// Uint64 constructs a field holding a uint64.
+func Uint64(key string, val uint64) Field {
+	return Field{Key: key, Type: UintType, num: int64(val)}
+}
+
+// Float64 constructs a field holding a float64.
+func Float64(key string, val float64) Field {
+	return Field{Key: key, Type: FloatType, num: int64(math.Float64bits(val))}
+}
+
+// Bool constructs a field holding a bool.
+func Bool(key string, val bool) Field {
+	f := Field{Key: key, Type: BoolType}
+	if val {
+		f.num = 1
+	}
+	return f
+}
+
+// Duration constructs a field holding a time.Duration.
+func Duration(key string, val time.Duration) Field {
+	return Field{Key: key, Type: DurationType, num: int64(val)}
+}
+
+// Time constructs a field holding a time.Time.
+func Time(key string, val time.Time) Field {
+	return Field{Key: key, Type: TimeType, iface: val}
+}
+
+// ErrorInfo describes one error in the chain recorded by an Err field.
+type ErrorInfo struct {
+	Type    string `json:"type"`    // The dynamic type of the error, such as "*fs.PathError"
+	Message string `json:"message"` // The result of its Error method
+}
+
+// The most errors recorded from one chain, which guards against cycles
+const maxErrorChain = 32
+
+type errorValue struct {
+	err   error
+	chain []ErrorInfo
+}
+
+// Err constructs a field with the key "error" holding err.  See NamedErr.
+func Err(err error) Field {
+	return NamedErr("error", err)
+}
+
+// NamedErr constructs a field holding err together with the chain of errors it
+// wraps, as found by errors.Unwrap (and through errors.Join, depth first).  The
+// chain is recorded when the field is built, so writers can render it after the
+// errors have changed.
+func NamedErr(key string, err error) Field {
+	return Field{Key: key, Type: ErrorType, iface: errorValue{err, errorChain(err)}}
+}
+
+func errorChain(err error) []ErrorInfo {
+	var chain []ErrorInfo
+	var walk func(err error)
+	walk = func(err error) {
+		for err != nil && len(chain) < maxErrorChain {
+			chain = append(chain, ErrorInfo{fmt.Sprintf("%T", err), err.Error()})
+			switch e := err.(type) {
+			case interface{ Unwrap() error }:
+				err = e.Unwrap()
+			case interface{ Unwrap() []error }:
+				for _, err := range e.Unwrap() {
+					walk(err)
+				}
+				return
+			default:
+				return
+			}
+		}
+	}
+	walk(err)
+	return chain
+}
+
+// ErrorChain returns the chain of errors recorded by an Err field, beginning
+// with the error itself, or nil for other fields.
+func (f Field) ErrorChain() []ErrorInfo {
+	if ev, ok := f.iface.(errorValue); ok && f.Type == ErrorType {
+		return ev.chain
+	}
+	return nil
+}
+
+// Any constructs a field holding val, using the most specific FieldType
+// available for its dynamic type.
+func Any(key string, val interface{}) Field {
+	switch v := val.(type) {
+	case string:
+		return String(key, v)
+	case int:
+		return Int(key, v)
+	case int8:
+		return Int64(key, int64(v))
+	case int16:
+		return Int64(key, int64(v))
+	case int32:
+		return Int64(key, int64(v))
+	case int64:
+		return Int64(key, v)
+	case uint:
+		return Uint64(key, uint64(v))
+	case uint8:
+		return Uint64(key, uint64(v))
+	case uint16:
+		return Uint64(key, uint64(v))
+	case uint32:
+		return Uint64(key, uint64(v))
+	case uint64:
+		return Uint64(key, v)
+	case float32:
+		return Float64(key, float64(v))
+	case float64:
+		return Float64(key, v)
+	case bool:
+		return Bool(key, v)
+	case time.Duration:
+		return Duration(key, v)
+	case time.Time:
+		return Time(key, v)
+	case error:
+		return NamedErr(key, v)
+	}
+	return Field{Key: key, Type: AnyType, iface: val}
+}
+
+// Value returns the value held by the field.
+func (f Field) Value() interface{} {
+	switch f.Type {
+	case StringType:
+		return f.str
+	case IntType:
+		return f.num
+	case UintType:
+		return uint64(f.num)
+	case FloatType:
+		return math.Float64frombits(uint64(f.num))
+	case BoolType:
+		return f.num != 0
+	case DurationType:
+		return time.Duration(f.num)
+	case ErrorType:
+		ev, _ := f.iface.(errorValue)
+		return ev.err
+	}
+	return f.iface
+}
+
+// appendText appends the plain text form of the field's value to buf.
+func (f Field) appendText(buf []byte) []byte {
+	switch f.Type {
+	case StringType:
+		return append(buf, f.str...)
+	case IntType:
+		return strconv.AppendInt(buf, f.num, 10)
+	case UintType:
+		return strconv.AppendUint(buf, uint64(f.num), 10)
+	case FloatType:
+		return strconv.AppendFloat(buf, math.Float64frombits(uint64(f.num)), 'g', -1, 64)
+	case BoolType:
+		return strconv.AppendBool(buf, f.num != 0)
+	case DurationType:
+		return append(buf, time.Duration(f.num).String()...)
+	case TimeType:
+		// Fields built by hand have no payload
+		if t, ok := f.iface.(time.Time); ok {
+			return t.AppendFormat(buf, time.RFC3339Nano)
+		}
+	case ErrorType:
+		if ev, _ := f.iface.(errorValue); ev.err != nil {
+			return append(buf, ev.err.Error()...)
+		}
+		return append(buf, "<nil>"...)
+	}
+	return append(buf, fmt.Sprint(f.iface)...)
+}
+
+// Fields is the list of fields attached to a LogRecord.  It marshals to JSON
+// as an object keyed by field name, in which an Err field is an object holding
+// the message and the chain of the error, or null.
+type Fields []Field
+
+// Get returns the value of the last field with the given key.
+func (fs Fields) Get(key string) (interface{}, bool) {
+	if f, ok := fs.lookup(key); ok {
+		return f.Value(), true
+	}
+	return nil, false
+}
+
+// lookup returns the last field with the given key, so that fields added by a
+// child logger take precedence over those of its parent.
+func (fs Fields) lookup(key string) (Field, bool) {
+	for i := len(fs) - 1; i >= 0; i-- {
+		if fs[i].Key == key {
+			return fs[i], true
+		}
+	}
+	return Field{}, false
+}
+
+func (ev errorValue) MarshalJSON() ([]byte, error) {
+	if ev.err == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(struct {
+		Message string      `json:"message"`
+		Chain   []ErrorInfo `json:"chain"`
+	}{ev.err.Error(), ev.chain})
+}
+
+// MarshalJSON encodes the fields as a JSON object, in order.
+func (fs Fields) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 16*len(fs)+2)
+	buf = append(buf, '{')
+	for i, f := range fs {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, f.Key)
+		buf = append(buf, ':')
+		buf = f.appendJSON(buf)
+	}
+	return append(buf, '}'), nil
+}
+
+// appendJSON appends the JSON encoding of the field's value to buf.  Values
+// which cannot be encoded are encoded as the strings fmt makes of them.
+func (f Field) appendJSON(buf []byte) []byte {
+	switch f.Type {
+	case IntType, UintType, BoolType:
+		return f.appendText(buf)
+	case FloatType:
+		if v := math.Float64frombits(uint64(f.num)); !math.IsInf(v, 0) && !math.IsNaN(v) {
+			return f.appendText(buf)
+		}
+	case ErrorType:
+		ev, _ := f.iface.(errorValue)
+		if val, err := ev.MarshalJSON(); err == nil {
+			return append(buf, val...)
+		}
+	case AnyType:
+		if val, err := json.Marshal(f.iface); err == nil {
+			return append(buf, val...)
+		}
+		return appendJSONString(buf, fmt.Sprint(f.iface))
+	}
+	switch f.Type {
+	case StringType:
+		return appendJSONString(buf, f.str)
+	case FloatType, DurationType, TimeType:
+		// Their text needs no escaping
+		buf = append(buf, '"')
+		buf = f.appendText(buf)
+		return append(buf, '"')
+	}
+	return appendJSONString(buf, string(f.appendText(nil)))
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s to buf as a JSON string.  Invalid UTF-8 is
+// replaced by U+FFFD, as encoding/json does, but HTML characters are not
+// escaped.
+func appendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= ' ' && b != '"' && b != '\\' {
+				i++
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				buf = append(buf, '\\', b)
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		// Line and paragraph separators break JavaScript
+		if r == '\u2028' || r == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
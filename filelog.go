@@ -4,6 +4,7 @@ package log4go
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"time"
@@ -12,6 +13,7 @@ import (
 	"io/ioutil"
 	"sort"
 	"io"
+	"os/signal"
 	"path/filepath"
 	//"reflect"
 )
@@ -21,10 +23,12 @@ type timer struct {
 	scr bool
 }
 
-// This log writer sends output to a file
+// This log writer sends output to a file.  What it does when its queue is full
+// is set with SetOverflow.
 type FileLogWriter struct {
-	rec chan *LogRecord
-	rot chan bool
+	*recordQueue
+	rot   chan bool
+	flush chan chan error // requests to write out the buffer (see Flush)
 
 	defaultFilename string
 
@@ -33,8 +37,8 @@ type FileLogWriter struct {
 	file     *os.File
 	suffixCounter int
 
-	// The logging format
-	format string
+	// How records are written
+	formatter atomicValue[Formatter]
 
 	// File header/trailer
 	header, trailer string
@@ -70,13 +74,14 @@ type FileLogWriter struct {
 
 // This is the FileLogWriter's output method
 func (w *FileLogWriter) LogWrite(rec *LogRecord) {
-	w.rec <- rec
+	w.put(rec)
 	//fmt.Printf("len=%d, cap=%d\n", len(w.rec), cap(w.rec))
 }
 
+// Close stops the writer, waiting until it has written the records queued and
+// closed the file.  See CloseContext.
 func (w *FileLogWriter) Close() {
-	close(w.rec)
-	w.file.Sync()
+	w.CloseContext(context.Background())
 }
 
 // NewFileLogWriter creates a new LogWriter which writes to the given file and
@@ -91,17 +96,16 @@ func (w *FileLogWriter) Close() {
 func NewFileLogWriter(fname string, rotate bool) *FileLogWriter {
 	var err error
 	var offset int 
-	var nbuf, n int
+	var n int
 	var window int
 	offset = 0
 	n = 0
-	nbuf = 0
 	w := &FileLogWriter{
-		rec:       		  make(chan *LogRecord, LogBufferLength),
+		recordQueue:      newRecordQueue(LogBufferLength),
+		flush:            make(chan chan error),
 		rot:       		  make(chan bool),
 		defaultFilename:  fname,
 		filename: 		  fname,
-		format:   		  "[%D %T] [%L] (%S) %M",
 		rotate:   		  rotate,
 		maxbackup:		  999,
 		//buffer: 		    make([]byte, w.capacity),
@@ -112,13 +116,15 @@ func NewFileLogWriter(fname string, rotate bool) *FileLogWriter {
 		position: 		  0,
 	}
 
+	w.SetFormat("[%D %T] [%L] (%S) %M")
+
 	// handle shutdown signals
 	s := make(chan os.Signal, 1)
 	notifySignals(s)
 
 	// open the file for the first time
 	if err = w.initializeNewFile(true); err != nil {
-		fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+		DefaultErrorHandler(&WriterError{Writer: fmt.Sprintf("FileLogWriter(%q)", w.filename), Op: "open", Err: err})
 		return nil
 	}
 
@@ -126,20 +132,37 @@ func NewFileLogWriter(fname string, rotate bool) *FileLogWriter {
 	t := NewTimer(time.Duration(w.timeout))
 
 	go func() {
+		var line []byte // the record being written, reused
 
 		defer func() {
+			t.Stop()
+			signal.Stop(s)
+			var cerr error
 			if w.file != nil {
+				// Write out buffered logging before the trailer
+				if w.buff.Len() > 0 {
+					_, cerr = fmt.Fprint(w.file, w.buff.String())
+					w.buff.Reset()
+				}
 				fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
-				w.file.Close()
+				if err := w.file.Sync(); cerr == nil {
+					cerr = err
+				}
+				if err := w.file.Close(); cerr == nil {
+					cerr = err
+				}
 			}
+			if cerr != nil {
+				w.fileError("close", cerr)
+			}
+			w.exit(cerr)
 		}()
 
 		for {
 		    	select {
 			case <-w.rot:
 				if err = w.initializeNewFile(false); err != nil {
-					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-					return
+					w.fileError("rotate", err)
 				}
 			case <-t.C:
 				t.SCR()
@@ -147,24 +170,38 @@ func NewFileLogWriter(fname string, rotate bool) *FileLogWriter {
 					// fmt.Println("received timeout signal <<<<")
 					// fmt.Printf("file=%s, buff_content=%d\n", w.file, offset+w.position)
 					n, err = fmt.Fprint(w.file, (string)(w.buff.String()))
+					if err != nil {
+						w.fileError("write", err)
+					}
 					w.position =0
 					w.buff.Reset()
 				}
 				// reset timer
 				t.SafeReset(time.Duration(w.timeout))
+			case reply := <-w.flush:
+				var ferr error
+				if w.buff.Len() > 0 {
+					_, ferr = fmt.Fprint(w.file, w.buff.String())
+					w.position = 0
+					w.buff.Reset()
+				}
+				if serr := w.file.Sync(); ferr == nil {
+					ferr = serr
+				}
+				reply <- ferr
 			case <-s:
 				fmt.Println("received shutdown signals <<<<")
 				if w.log_var == true {
-					fmt.Printf("file=%s, buff_content=%d\n", w.file, offset+w.position)
+					fmt.Printf("file=%s, buff_content=%d\n", w.filename, offset+w.position)
 					n, err = fmt.Fprint(w.file, (string)(w.buff.String()))
 					w.position =0;
 					w.buff.Reset()
 					os.Exit(1)
 				} else {
-					fmt.Println("Log buff disabled, no action\n")
+					fmt.Println("Log buff disabled, no action")
 					os.Exit(1)
 				}
-			case rec, ok := <-w.rec:
+			case rec, ok := <-w.ch:
 				if !ok {
 					return
 				}
@@ -174,23 +211,25 @@ func NewFileLogWriter(fname string, rotate bool) *FileLogWriter {
 					// flush buffer 
 					n, err = fmt.Fprint(w.file, (string)(w.buff.String()))
 					if err != nil {
-						fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-						return
+						w.fileError("write", err)
 					}
 					w.position =0
 					w.buff.Reset()
 
 					if err = w.initializeNewFile(false); err != nil {
-						fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-						return
+						w.fileError("rotate", err)
 					}
 				}
+				line = w.formatter.Load().Format(rec, line[:0])
 				if w.log_var == false {
 					//fmt.Println("one(w) <----w.rec")
-					n, err = fmt.Fprint(w.file, FormatLogRecord(w.format, rec))
+					n, err = w.file.Write(line)
+					if err != nil {
+						w.fileError("write", err)
+					}
 				} else {
 					// compute length of record 
-					record_len := len(string(FormatLogRecord(w.format, rec)))
+					record_len := len(line)
 					// fmt.Println("rec=", rec)
 					//////////////// trial code for buffer flexibility
 					window = w.capacity - w.position
@@ -202,10 +241,9 @@ func NewFileLogWriter(fname string, rotate bool) *FileLogWriter {
 						// fmt.Printf("rec_len=%d, diff=%d\n", record_len, w.capacity-w.position)
 						// write to buffer
 						// update the accumulation
-						offset, err = w.buff.WriteString(string(FormatLogRecord(w.format, rec)))
+						offset, err = w.buff.Write(line)
 						if err != nil {
-							fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-							return
+							w.fileError("write", err)
 						}
 						w.position += offset 
 						n = offset
@@ -213,12 +251,15 @@ func NewFileLogWriter(fname string, rotate bool) *FileLogWriter {
 						// fmt.Println("buff(w) <----w.rec")
 						// elapsed := time.Since(now)
 						// fmt.Printf("[<-]-- Buffer fill time %s", elapsed)
-						nbuf, err = fmt.Fprint(w.file, (string)(w.buff.String()))
+						_, err = fmt.Fprint(w.file, (string)(w.buff.String()))
+						if err != nil {
+							w.fileError("write", err)
+						}
 						w.position =0;
 						w.buff.Reset()
 
 						//handle additional record
-						offset, err = w.buff.WriteString(string(FormatLogRecord(w.format, rec)))
+						offset, err = w.buff.Write(line)
 						w.position += offset
 						t.SafeReset(time.Duration(w.timeout)) // early
 					}	
@@ -250,6 +291,7 @@ func NewFileLogWriter(fname string, rotate bool) *FileLogWriter {
 				// Update the counts
 				w.maxlines_curlines++
 				w.maxsize_cursize += n 
+				w.wrote(rec)
 				//fmt.Printf("lines=%d, size=%d\n", w.maxlines_curlines, w.maxsize_cursize)
 			}
 		}
@@ -257,6 +299,34 @@ func NewFileLogWriter(fname string, rotate bool) *FileLogWriter {
 	return w
 }
 
+// Flush waits until the records queued before the call have been written, then
+// writes out what buffered logging (see SetBlog) holds and syncs the file to
+// disk, or gives up when ctx is done.
+func (w *FileLogWriter) Flush(ctx context.Context) error {
+	if err := w.recordQueue.Flush(ctx); err != nil {
+		return err
+	}
+	reply := make(chan error, 1)
+	select {
+	case w.flush <- reply:
+	case <-w.done:
+		return nil // closed, so nothing is left to write
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pass a failure of the writer to its error handler
+func (w *FileLogWriter) fileError(op string, err error) {
+	w.fail(&WriterError{Writer: fmt.Sprintf("FileLogWriter(%q)", w.filename), Op: op, Err: err})
+}
+
 // Request that the logs rotate
 func (w *FileLogWriter) Rotate() {
 	w.rot <- true
@@ -408,10 +478,16 @@ func (w *FileLogWriter) SetCapacity(capacity int) *FileLogWriter {
 	return w
 }
 
-// Set the logging format (chainable).  Must be called before the first log
-// message is written.
+// Set the logging format (chainable).  It is safe to call while messages are
+// being logged.
 func (w *FileLogWriter) SetFormat(format string) *FileLogWriter {
-	w.format = format
+	return w.SetFormatter(compileWriterFormat(w.recordQueue, fmt.Sprintf("FileLogWriter(%q)", w.filename), format))
+}
+
+// SetFormatter sets how the records are written (chainable).  It is safe to
+// call while messages are being logged.
+func (w *FileLogWriter) SetFormatter(f Formatter) *FileLogWriter {
+	w.formatter.Store(f)
 	return w
 }
 
@@ -478,12 +554,12 @@ func (w *FileLogWriter) SetRotate(rotate bool) *FileLogWriter {
 // NewXMLLogWriter is a utility method for creating a FileLogWriter set up to
 // output XML record log messages instead of line-based ones.
 func NewXMLLogWriter(fname string, rotate bool) *FileLogWriter {
-	return NewFileLogWriter(fname, rotate).SetFormat(
-		`	<record level="%L">
-		<timestamp>%D %T</timestamp>
-		<source>%S</source>
-		<message>%M</message>
-	</record>`).SetHeadFoot("<log created=\"%D %T\">", "</log>")
+	w := NewFileLogWriter(fname, rotate)
+	if w == nil {
+		return nil
+	}
+	w.SetFormatter(XMLFormatter{})
+	return w.SetHeadFoot("<log created=\"%D %T\">", "</log>")
 }
 
 /*
@@ -0,0 +1,463 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Formatter renders log records for a writer (see the SetFormatter methods
+// of the writers).  The formatters of this package are PatternFormatter (see
+// CompileFormat), JSONFormatter, XMLFormatter and LogfmtFormatter.  A Formatter
+// must be safe for use by multiple goroutines.
+type Formatter interface {
+	// Format appends rec, formatted as one entry ending with a newline, to
+	// buf and returns the extended buffer.
+	Format(rec *LogRecord, buf []byte) []byte
+}
+
+// JSONFormatter formats records as JSON objects, one per line (JSON Lines):
+//
+//	{"time":"2009-02-13T23:31:30.123456789Z","level":"INFO","logger":"app","source":"main.main:12","msg":"hello","trace_id":"...","span_id":"...","fields":{"user":"kyle"},"stack":"..."}
+//
+// Logger, trace and span IDs, fields and stack are left out when they are
+// empty.  The zero JSONFormatter writes records as above; its fields change
+// the names of the keys, the time layout, the style of the level and whether
+// fields are nested.
+type JSONFormatter struct {
+	// The keys of the members of the object; empty ones are "time", "level",
+	// "msg", "source", "logger" and "fields"
+	TimeKey    string
+	LevelKey   string
+	MessageKey string
+	SourceKey  string
+	LoggerKey  string
+	FieldsKey  string
+
+	// TimeLayout is the layout of the time (see time.Time.Format), or one of
+	// TimeUnix, TimeUnixMilli, TimeUnixMicro and TimeUnixNano for a number.
+	// Empty means time.RFC3339Nano.
+	TimeLayout string
+
+	// LevelStyle is how the level is written; the zero style is LevelName.
+	LevelStyle LevelStyle
+
+	// FlattenFields writes the fields of records as members of the object
+	// itself, after the others, instead of as an object under FieldsKey.  The
+	// keys of fields which are also keys of the other members, such as "msg"
+	// or "trace_id", are prefixed with FieldsKey and a dot, as "fields.msg",
+	// so that they do not collide.
+	FlattenFields bool
+}
+
+// Time layouts of JSONFormatter which write the time as the integer number of
+// seconds, milliseconds, microseconds or nanoseconds since the Unix epoch
+const (
+	TimeUnix      = "unix"
+	TimeUnixMilli = "unixmilli"
+	TimeUnixMicro = "unixmicro"
+	TimeUnixNano  = "unixnano"
+)
+
+// TimeLayouts maps the names of the layouts of the time package, such as
+// "RFC3339", to the layouts.  The configuration accepts these names wherever
+// it takes a time layout.
+var TimeLayouts = map[string]string{
+	"ANSIC":       time.ANSIC,
+	"UnixDate":    time.UnixDate,
+	"RubyDate":    time.RubyDate,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"RFC850":      time.RFC850,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"Kitchen":     time.Kitchen,
+	"Stamp":       time.Stamp,
+	"StampMilli":  time.StampMilli,
+	"StampMicro":  time.StampMicro,
+	"StampNano":   time.StampNano,
+}
+
+// A LevelStyle is how JSONFormatter writes the level of a record.
+type LevelStyle int
+
+const (
+	LevelName   LevelStyle = iota // The full name of the level, such as "WARNING"
+	LevelShort                    // The short name of the level, such as "WARN"
+	LevelNumber                   // The level as a number, such as 5
+)
+
+// Return the key, or def if it is empty
+func jsonKey(key, def string) string {
+	if len(key) == 0 {
+		return def
+	}
+	return key
+}
+
+func (f JSONFormatter) Format(rec *LogRecord, buf []byte) []byte {
+	buf = append(buf, '{')
+	buf = appendJSONString(buf, jsonKey(f.TimeKey, "time"))
+	buf = append(buf, ':')
+	switch f.TimeLayout {
+	case TimeUnix:
+		buf = strconv.AppendInt(buf, rec.Created.Unix(), 10)
+	case TimeUnixMilli:
+		buf = strconv.AppendInt(buf, rec.Created.UnixNano()/int64(time.Millisecond), 10)
+	case TimeUnixMicro:
+		buf = strconv.AppendInt(buf, rec.Created.UnixNano()/int64(time.Microsecond), 10)
+	case TimeUnixNano:
+		buf = strconv.AppendInt(buf, rec.Created.UnixNano(), 10)
+	case "":
+		buf = append(buf, '"')
+		buf = rec.Created.AppendFormat(buf, time.RFC3339Nano)
+		buf = append(buf, '"')
+	default:
+		start := len(buf)
+		buf = rec.Created.AppendFormat(buf, f.TimeLayout)
+		// The layout may hold anything
+		stamp := string(buf[start:])
+		buf = appendJSONString(buf[:start], stamp)
+	}
+
+	buf = append(buf, ',')
+	buf = appendJSONString(buf, jsonKey(f.LevelKey, "level"))
+	buf = append(buf, ':')
+	switch f.LevelStyle {
+	case LevelNumber:
+		buf = strconv.AppendInt(buf, int64(rec.Level), 10)
+	case LevelShort:
+		buf = appendJSONString(buf, rec.Level.String())
+	default:
+		buf = appendJSONString(buf, rec.Level.Name())
+	}
+
+	if len(rec.Category) > 0 {
+		buf = appendJSONPair(buf, jsonKey(f.LoggerKey, "logger"), rec.Category)
+	}
+	buf = appendJSONPair(buf, jsonKey(f.SourceKey, "source"), rec.Source)
+	buf = appendJSONPair(buf, jsonKey(f.MessageKey, "msg"), rec.Message)
+	if len(rec.TraceID) > 0 {
+		buf = appendJSONPair(buf, "trace_id", rec.TraceID)
+		buf = appendJSONPair(buf, "span_id", rec.SpanID)
+	}
+
+	if len(rec.Fields) > 0 {
+		if !f.FlattenFields {
+			buf = append(buf, ',')
+			buf = appendJSONString(buf, jsonKey(f.FieldsKey, "fields"))
+			buf = append(buf, ":{"...)
+		}
+		for i, field := range rec.Fields {
+			if i > 0 || f.FlattenFields {
+				buf = append(buf, ',')
+			}
+			if f.FlattenFields && f.reservedKey(field.Key) {
+				buf = appendJSONString(buf, jsonKey(f.FieldsKey, "fields")+"."+field.Key)
+			} else {
+				buf = appendJSONString(buf, field.Key)
+			}
+			buf = append(buf, ':')
+			buf = field.appendJSON(buf)
+		}
+		if !f.FlattenFields {
+			buf = append(buf, '}')
+		}
+	}
+
+	if len(rec.Stack) > 0 {
+		buf = appendJSONPair(buf, "stack", rec.Stack)
+	}
+	return append(buf, "}\n"...)
+}
+
+// Report whether key is the key of a member other than the fields
+func (f JSONFormatter) reservedKey(key string) bool {
+	switch key {
+	case jsonKey(f.TimeKey, "time"), jsonKey(f.LevelKey, "level"), jsonKey(f.LoggerKey, "logger"),
+		jsonKey(f.SourceKey, "source"), jsonKey(f.MessageKey, "msg"), "trace_id", "span_id", "stack":
+		return true
+	}
+	return false
+}
+
+// Append ,"key":"val"
+func appendJSONPair(buf []byte, key, val string) []byte {
+	buf = append(buf, ',')
+	buf = appendJSONString(buf, key)
+	buf = append(buf, ':')
+	return appendJSONString(buf, val)
+}
+
+// XMLFormatter formats records as <record> elements, as NewXMLLogWriter
+// writes them.  Fields are written as <field key="..."> children of a <fields>
+// element (holding an <error type="..."> element for each error in the chain
+// of an Err field), and a stack trace as the text of a <stack> element.
+type XMLFormatter struct{}
+
+// Formats the <timestamp> of XML records
+var xmlTimestamp, _ = CompileFormat("%D %T")
+
+func (XMLFormatter) Format(rec *LogRecord, buf []byte) []byte {
+	out := bytes.NewBuffer(buf)
+	var stamp [64]byte
+	out.WriteString("\t<record level=\"")
+	xml.EscapeText(out, []byte(rec.Level.String()))
+	out.WriteString("\">\n")
+	out.WriteString("\t\t<timestamp>")
+	out.Write(xmlTimestamp.appendParts(stamp[:0], rec, "", ""))
+	out.WriteString("</timestamp>\n")
+	if len(rec.Category) > 0 {
+		out.WriteString("\t\t<logger>")
+		xml.EscapeText(out, []byte(rec.Category))
+		out.WriteString("</logger>\n")
+	}
+	out.WriteString("\t\t<source>")
+	xml.EscapeText(out, []byte(rec.Source))
+	out.WriteString("</source>\n\t\t<message>")
+	xml.EscapeText(out, []byte(rec.Message))
+	out.WriteString("</message>\n")
+	if len(rec.TraceID) > 0 {
+		out.WriteString("\t\t<trace id=\"")
+		xml.EscapeText(out, []byte(rec.TraceID))
+		out.WriteString("\" span=\"")
+		xml.EscapeText(out, []byte(rec.SpanID))
+		out.WriteString("\"/>\n")
+	}
+	if len(rec.Fields) > 0 {
+		out.WriteString("\t\t<fields>\n")
+		for _, f := range rec.Fields {
+			out.WriteString("\t\t\t<field key=\"")
+			xml.EscapeText(out, []byte(f.Key))
+			out.WriteString("\">")
+			if chain := f.ErrorChain(); len(chain) > 0 {
+				for _, info := range chain {
+					out.WriteString("<error type=\"")
+					xml.EscapeText(out, []byte(info.Type))
+					out.WriteString("\">")
+					xml.EscapeText(out, []byte(info.Message))
+					out.WriteString("</error>")
+				}
+			} else {
+				xml.EscapeText(out, f.appendText(nil))
+			}
+			out.WriteString("</field>\n")
+		}
+		out.WriteString("\t\t</fields>\n")
+	}
+	if len(rec.Stack) > 0 {
+		out.WriteString("\t\t<stack>")
+		xml.EscapeText(out, []byte(rec.Stack))
+		out.WriteString("</stack>\n")
+	}
+	out.WriteString("\t</record>\n")
+	return out.Bytes()
+}
+
+// LogfmtFormatter formats records as lines of key=value pairs:
+//
+//	ts=2009-02-13T23:31:30.123456789Z level=info src=main.main:12 msg="hello world" user=kyle
+//
+// followed by logger, trace_id and span_id when they are set, the fields of the
+// record, and stack.  Values which are empty or hold spaces, quotes, equals
+// signs or unprintable characters are quoted as Go strings, so every record is
+// one line.  Those characters are replaced by underscores in the keys of fields.
+// ParseLogfmt reads the lines back.
+type LogfmtFormatter struct{}
+
+func (LogfmtFormatter) Format(rec *LogRecord, buf []byte) []byte {
+	buf = append(buf, "ts="...)
+	buf = rec.Created.AppendFormat(buf, time.RFC3339Nano)
+	buf = append(buf, " level="...)
+	start := len(buf)
+	for _, c := range []byte(rec.Level.Name()) {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		buf = append(buf, c)
+	}
+	if name := buf[start:]; logfmtNeedsQuote(string(name)) {
+		quoted := strconv.AppendQuote(nil, string(name))
+		buf = append(buf[:start], quoted...)
+	}
+	buf = appendLogfmtPair(buf, "src", rec.Source)
+	buf = appendLogfmtPair(buf, "msg", rec.Message)
+	if len(rec.Category) > 0 {
+		buf = appendLogfmtPair(buf, "logger", rec.Category)
+	}
+	if len(rec.TraceID) > 0 {
+		buf = appendLogfmtPair(buf, "trace_id", rec.TraceID)
+		buf = appendLogfmtPair(buf, "span_id", rec.SpanID)
+	}
+	for _, f := range rec.Fields {
+		buf = append(buf, ' ')
+		buf = appendLogfmtKey(buf, f.Key)
+		buf = append(buf, '=')
+		start = len(buf)
+		buf = f.appendText(buf)
+		if val := buf[start:]; logfmtNeedsQuote(string(val)) {
+			quoted := strconv.AppendQuote(nil, string(val))
+			buf = append(buf[:start], quoted...)
+		}
+	}
+	if len(rec.Stack) > 0 {
+		buf = appendLogfmtPair(buf, "stack", rec.Stack)
+	}
+	return append(buf, '\n')
+}
+
+// Append " key=value", quoting the value if necessary
+func appendLogfmtPair(buf []byte, key, val string) []byte {
+	buf = append(buf, ' ')
+	buf = append(buf, key...)
+	buf = append(buf, '=')
+	if logfmtNeedsQuote(val) {
+		return strconv.AppendQuote(buf, val)
+	}
+	return append(buf, val...)
+}
+
+// Append the key of a field, replacing what would end it with underscores
+func appendLogfmtKey(buf []byte, key string) []byte {
+	if len(key) == 0 {
+		return append(buf, '_')
+	}
+	for _, r := range key {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError || !unicode.IsPrint(r) {
+			r = '_'
+		}
+		buf = utf8.AppendRune(buf, r)
+	}
+	return buf
+}
+
+// Report whether a logfmt value must be quoted
+func logfmtNeedsQuote(val string) bool {
+	if len(val) == 0 {
+		return true
+	}
+	for _, r := range val {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseLogfmt parses a line written by LogfmtFormatter back into a record.
+// The ts and level keys must be present.  The first ts, level, src, msg,
+// logger, trace_id, span_id and stack keys set the members of the record;
+// other keys, and those ones repeated, become String fields, in order, except
+// that a key without a value becomes a Bool field set to true.  A field named
+// like one of the optional keys which the record had no value for, such as
+// logger, is read back as that key.
+func ParseLogfmt(line string) (*LogRecord, error) {
+	rec := new(LogRecord)
+	var hasTime, hasLevel bool
+	seen := make(map[string]bool)
+	line = strings.TrimSpace(line)
+	for i := 0; i < len(line); {
+		start := i
+		for i < len(line) && line[i] != ' ' && line[i] != '=' {
+			i++
+		}
+		key := line[start:i]
+		if len(key) == 0 {
+			return nil, fmt.Errorf("log4go: logfmt: missing key at offset %d", start)
+		}
+		if i == len(line) || line[i] == ' ' {
+			rec.Fields = append(rec.Fields, Bool(key, true))
+			i = skipSpaces(line, i)
+			continue
+		}
+
+		// Value
+		i++
+		start = i
+		var val string
+		if i < len(line) && line[i] == '"' {
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("log4go: logfmt: unterminated value of %s", key)
+			}
+			i++
+			var err error
+			if val, err = strconv.Unquote(line[start:i]); err != nil {
+				return nil, fmt.Errorf("log4go: logfmt: malformed value of %s: %s", key, line[start:i])
+			}
+			if i < len(line) && line[i] != ' ' {
+				return nil, fmt.Errorf("log4go: logfmt: missing space after the value of %s", key)
+			}
+		} else {
+			for i < len(line) && line[i] != ' ' {
+				i++
+			}
+			val = line[start:i]
+		}
+		i = skipSpaces(line, i)
+
+		if seen[key] {
+			rec.Fields = append(rec.Fields, String(key, val))
+			continue
+		}
+		switch key {
+		case "ts":
+			created, err := time.Parse(time.RFC3339Nano, val)
+			if err != nil {
+				return nil, fmt.Errorf("log4go: logfmt: malformed ts %q", val)
+			}
+			rec.Created, hasTime = created, true
+		case "level":
+			lvl, err := ParseLevel(val)
+			if err != nil {
+				return nil, fmt.Errorf("log4go: logfmt: unknown level %q", val)
+			}
+			rec.Level, hasLevel = lvl, true
+		case "src":
+			rec.Source = val
+		case "msg":
+			rec.Message = val
+		case "logger":
+			rec.Category = val
+		case "trace_id":
+			rec.TraceID = val
+		case "span_id":
+			rec.SpanID = val
+		case "stack":
+			rec.Stack = val
+		default:
+			rec.Fields = append(rec.Fields, String(key, val))
+			continue
+		}
+		seen[key] = true
+	}
+	if !hasTime {
+		return nil, errors.New("log4go: logfmt: missing ts")
+	}
+	if !hasLevel {
+		return nil, errors.New("log4go: logfmt: missing level")
+	}
+	return rec, nil
+}
+
+// Return the index of the first byte from i on which is not a space
+func skipSpaces(line string, i int) int {
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,180 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Full level names, as used in configuration files
+var levelNames = [...]string{"FINEST", "FINE", "DEBUG", "TRACE", "INFO", "WARNING", "ERROR", "CRITICAL"}
+
+// The levels registered with RegisterLevel.  The table is replaced as a whole
+// when a level is registered, so lookups need no lock.
+type levelTable struct {
+	names  map[Level][2]string // full and short name
+	byName map[string]Level    // upper-case full and short names
+}
+
+var (
+	customLevels   atomicValue[*levelTable]
+	registerLevels sync.Mutex
+)
+
+func loadLevels() *levelTable {
+	return customLevels.Load()
+}
+
+// RegisterLevel adds a level with the given full and short names, such as
+// ("NOTICE", "NOTC"), which may then be logged with Log, Logf and Logc, used by
+// filters and parsed by ParseLevel.  Levels are ordered by value; the built-in
+// levels run from FINEST (0) to CRITICAL (7), so custom levels go below or
+// above them.  Names are case-insensitive, made of ASCII letters, digits and
+// underscores, and must not be in use.
+func RegisterLevel(lvl Level, name, short string) error {
+	if len(name) == 0 || len(short) == 0 {
+		return fmt.Errorf("log4go: level %d needs a name and a short name", lvl)
+	}
+	for _, n := range []string{name, short} {
+		if !validLevelName(n) {
+			return fmt.Errorf("log4go: level name %q is not made of letters, digits and underscores", n)
+		}
+	}
+	if lvl >= FINEST && lvl <= CRITICAL {
+		return fmt.Errorf("log4go: level %d is a built-in level", lvl)
+	}
+
+	registerLevels.Lock()
+	defer registerLevels.Unlock()
+	for _, n := range []string{name, short} {
+		if _, err := ParseLevel(n); err == nil {
+			return fmt.Errorf("log4go: level name %q is in use", n)
+		}
+	}
+
+	table := &levelTable{
+		names:  make(map[Level][2]string),
+		byName: make(map[string]Level),
+	}
+	if old := loadLevels(); old != nil {
+		if _, ok := old.names[lvl]; ok {
+			return fmt.Errorf("log4go: level %d is already registered", lvl)
+		}
+		for l, names := range old.names {
+			table.names[l] = names
+		}
+		for n, l := range old.byName {
+			table.byName[n] = l
+		}
+	}
+	table.names[lvl] = [2]string{name, short}
+	table.byName[strings.ToUpper(name)] = lvl
+	table.byName[strings.ToUpper(short)] = lvl
+	customLevels.Store(table)
+	return nil
+}
+
+// Remove a level added by RegisterLevel, for tests which register levels
+func unregisterLevel(lvl Level) {
+	registerLevels.Lock()
+	defer registerLevels.Unlock()
+	old := loadLevels()
+	if old == nil {
+		return
+	}
+	table := &levelTable{
+		names:  make(map[Level][2]string),
+		byName: make(map[string]Level),
+	}
+	for l, names := range old.names {
+		if l != lvl {
+			table.names[l] = names
+		}
+	}
+	for n, l := range old.byName {
+		if l != lvl {
+			table.byName[n] = l
+		}
+	}
+	customLevels.Store(table)
+}
+
+// Report whether name may be written as it is wherever levels are written
+func validLevelName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !('A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseLevel returns the level with the given full or short name (such as
+// "WARNING" or "WARN"), in any case, or with the given number.
+func ParseLevel(name string) (Level, error) {
+	upper := strings.ToUpper(strings.TrimSpace(name))
+	for i := range levelNames {
+		if upper == levelNames[i] || upper == levelStrings[i] {
+			return Level(i), nil
+		}
+	}
+	if table := loadLevels(); table != nil {
+		if lvl, ok := table.byName[upper]; ok {
+			return lvl, nil
+		}
+	}
+	if n, err := strconv.Atoi(upper); err == nil {
+		return Level(n), nil
+	}
+	return 0, fmt.Errorf("log4go: unknown level %q", name)
+}
+
+// Name returns the full name of the level, such as "WARNING", or its number if
+// it has no name.
+func (l Level) Name() string {
+	if l >= 0 && int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	if table := loadLevels(); table != nil {
+		if names, ok := table.names[l]; ok {
+			return names[0]
+		}
+	}
+	return strconv.Itoa(int(l))
+}
+
+// MarshalText encodes the level as its full name (or its number if it has no
+// name), which is also how it is encoded in JSON.
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.Name()), nil
+}
+
+// UnmarshalText decodes a level as ParseLevel does.
+func (l *Level) UnmarshalText(text []byte) error {
+	lvl, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = lvl
+	return nil
+}
+
+// UnmarshalJSON decodes a level from a name or, as older versions encoded it,
+// from a number.
+func (l *Level) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var n int
+		if json.Unmarshal(data, &n) != nil {
+			return fmt.Errorf("log4go: invalid level %s", data)
+		}
+		*l = Level(n)
+		return nil
+	}
+	return l.UnmarshalText([]byte(name))
+}
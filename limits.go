@@ -0,0 +1,249 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultReportInterval is how often a filter reports the records its limits
+// suppressed when Limits.ReportInterval is not set.
+const DefaultReportInterval = time.Minute
+
+// Limits throttles the records written by a filter (see Filter.SetLimits).
+// Sampling applies first, so records it drops do not use up the rate limit.
+type Limits struct {
+	// Sampling: in each SampleInterval, the first SampleFirst records with the
+	// same source and level are written, and after that every
+	// SampleThereafter-th (or none if it is zero).  Sampling is off while
+	// SampleInterval is zero.
+	SampleInterval   time.Duration
+	SampleFirst      int
+	SampleThereafter int
+
+	// Rate limiting: a bucket of Burst tokens (at least one), refilled at Rate
+	// tokens per second, from which every record written takes one.  Rate
+	// limiting is off while Rate is zero.
+	Rate  float64
+	Burst int
+
+	// The number of records suppressed is written as a summary record, at most
+	// once per ReportInterval: before the next record written, or by a timer
+	// once ReportInterval has passed if there is none, and when the filter is
+	// closed or its limits change.  Zero means DefaultReportInterval.
+	ReportInterval time.Duration
+}
+
+// The state of a filter with limits.  Records from any number of log calls go
+// through it at once, so it has a lock of its own.
+type limiter struct {
+	Limits
+
+	mu          sync.Mutex
+	sampleStart time.Time
+	samples     map[sampleKey]int
+	tokens      float64
+	refilled    time.Time
+
+	// Suppressed since the last summary
+	sampled, limited int
+	highest          Level
+	reported         time.Time
+
+	// Writes the summaries due while no record is written, if set.  The
+	// timer is armed while records are suppressed, until the limiter is
+	// stopped.
+	write   func(*LogRecord)
+	timer   *time.Timer
+	stopped bool
+}
+
+type sampleKey struct {
+	lvl Level
+	src string
+}
+
+func newLimiter(limits Limits, now time.Time) *limiter {
+	if limits.Burst < 1 {
+		limits.Burst = 1
+	}
+	if limits.ReportInterval <= 0 {
+		limits.ReportInterval = DefaultReportInterval
+	}
+	return &limiter{
+		Limits:      limits,
+		sampleStart: now,
+		samples:     make(map[sampleKey]int),
+		tokens:      float64(limits.Burst),
+		refilled:    now,
+		reported:    now,
+	}
+}
+
+// Decide whether rec may be written, and return the summary record which is
+// due to be written before it, if any
+func (lim *limiter) admit(rec *LogRecord) (ok bool, summary *LogRecord) {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+
+	now := rec.Created
+	ok = lim.sample(rec, now) && lim.take(now)
+	if !ok {
+		if lim.sampled+lim.limited == 0 || rec.Level > lim.highest {
+			lim.highest = rec.Level
+		}
+		lim.arm()
+		return false, nil
+	}
+	if now.Sub(lim.reported) >= lim.ReportInterval {
+		summary = lim.summary(now)
+	}
+	return true, summary
+}
+
+// Start the timer which writes the summary when it is due, unless it is
+// running.  Must be called with mu held.
+func (lim *limiter) arm() {
+	if lim.write == nil || lim.timer != nil || lim.stopped {
+		return
+	}
+	lim.timer = time.AfterFunc(time.Until(lim.reported.Add(lim.ReportInterval)), lim.reportDue)
+}
+
+// Write the summary if it is still due when the timer fires.  It is written
+// with mu held, so that stop waits for it before the writer is closed.
+func (lim *limiter) reportDue() {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	lim.timer = nil
+	if lim.stopped || lim.sampled+lim.limited == 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(lim.reported) < lim.ReportInterval {
+		// A record wrote a summary since the timer was armed
+		lim.arm()
+		return
+	}
+	lim.write(lim.summary(now))
+}
+
+// Stop the timer, and return the summary of what was not reported yet
+func (lim *limiter) stop() *LogRecord {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	lim.stopped = true
+	if lim.timer != nil {
+		lim.timer.Stop()
+		lim.timer = nil
+	}
+	return lim.summary(time.Now())
+}
+
+func (lim *limiter) sample(rec *LogRecord, now time.Time) bool {
+	if lim.SampleInterval <= 0 {
+		return true
+	}
+	if now.Sub(lim.sampleStart) >= lim.SampleInterval {
+		lim.sampleStart = now
+		lim.samples = make(map[sampleKey]int)
+	}
+	key := sampleKey{rec.Level, rec.Source}
+	n := lim.samples[key] + 1
+	lim.samples[key] = n
+	if n <= lim.SampleFirst {
+		return true
+	}
+	if lim.SampleThereafter > 0 && (n-lim.SampleFirst)%lim.SampleThereafter == 0 {
+		return true
+	}
+	lim.sampled++
+	return false
+}
+
+func (lim *limiter) take(now time.Time) bool {
+	if lim.Rate <= 0 {
+		return true
+	}
+	if elapsed := now.Sub(lim.refilled); elapsed > 0 {
+		lim.tokens += elapsed.Seconds() * lim.Rate
+		if max := float64(lim.Burst); lim.tokens > max {
+			lim.tokens = max
+		}
+		lim.refilled = now
+	}
+	if lim.tokens < 1 {
+		lim.limited++
+		return false
+	}
+	lim.tokens--
+	return true
+}
+
+// Return a record reporting the records suppressed since the last one, or nil
+// if there were none.  Must be called with mu held.
+func (lim *limiter) summary(now time.Time) *LogRecord {
+	since := lim.reported
+	lim.reported = now
+	if lim.sampled+lim.limited == 0 {
+		return nil
+	}
+	rec := &LogRecord{
+		Level:   lim.highest,
+		Created: now,
+		Source:  "log4go",
+		Message: fmt.Sprintf("suppressed %d records in %s (%d by sampling, %d by rate limit)",
+			lim.sampled+lim.limited, now.Sub(since).Round(time.Millisecond), lim.sampled, lim.limited),
+		Fields: Fields{Int("sampled", lim.sampled), Int("ratelimited", lim.limited)},
+	}
+	lim.sampled, lim.limited = 0, 0
+	return rec
+}
+
+// SetLimits makes the filter sample and rate limit the records it writes, and
+// report how many it suppressed; a nil limits removes them.  Changing the
+// limits resets their state, and reports what the old ones suppressed first.
+func (filt *Filter) SetLimits(limits *Limits) {
+	var lim *limiter
+	if limits != nil {
+		lim = newLimiter(*limits, time.Now())
+		lim.write = filt.LogWriter.LogWrite
+	}
+	filt.report(filt.limiter.Swap(lim))
+}
+
+// Limits returns the limits of the filter, or nil if it has none.
+func (filt *Filter) Limits() *Limits {
+	if lim := filt.limiter.Load(); lim != nil {
+		limits := lim.Limits
+		return &limits
+	}
+	return nil
+}
+
+// LogWrite writes rec to the LogWriter of the filter, subject to its limits.
+func (filt *Filter) LogWrite(rec *LogRecord) {
+	if lim := filt.limiter.Load(); lim != nil {
+		ok, summary := lim.admit(rec)
+		if summary != nil {
+			filt.LogWriter.LogWrite(summary)
+		}
+		if !ok {
+			rec.release()
+			return
+		}
+	}
+	filt.LogWriter.LogWrite(rec)
+}
+
+// Write what lim has suppressed and not yet reported, when it is no longer used
+func (filt *Filter) report(lim *limiter) {
+	if lim == nil {
+		return
+	}
+	if summary := lim.stop(); summary != nil {
+		filt.LogWriter.LogWrite(summary)
+	}
+}
@@ -23,6 +23,28 @@
 // log.AddFilter("log",    log4go.FINE,  log4go.NewFileLogWriter("example.log", true))
 // log.Info("The time is now: %s", time.LocalTime().Format("15:04:05 MST 2006/01/02"))
 //
+// Records can carry structured key/value fields.  With returns a child logger
+// which stamps its fields on every record it writes:
+//
+// reqlog := log.With(log4go.String("request", id), log4go.Int("shard", 3))
+// reqlog.Info("handling %s", path)
+//
+// Loggers form a hierarchy of named categories, as in log4j.  GetLogger returns
+// a named logger which inherits its threshold from its ancestors and also
+// writes to their filters:
+//
+// dblog := log.GetLogger("app.db")
+// dblog.SetThreshold(log4go.INFO)
+//
+// The Ctx variants (InfoCtx, LogCtx, etc) also take a context.Context and add
+// the fields attached with ContextWithFields and the trace and span IDs attached
+// with ContextWithTraceParent to each record.
+//
+// SetStackTrace makes serious records carry the stack of their caller, which
+// the %K format verb prints:
+//
+// log.SetStackTrace(&log4go.StackTrace{Level: log4go.ERROR, Depth: 16})
+//
 // Usage notes:
 // - The ConsoleLogWriter does not display the source of the message to standard
 //   output, but the FileLogWriter does.
@@ -33,24 +55,26 @@
 // - The external interface has remained mostly stable, but a lot of the
 //   internals have been changed, so if you depended on any of this or created
 //   your own LogWriter, then you will probably have to update your code.  In
-//   particular, Logger is now a map and ConsoleLogWriter is now a channel
-//   behind-the-scenes, and the LogWrite method no longer has return values.
+//   particular, Logger is now a struct created with NewLogger, ConsoleLogWriter
+//   is now a channel behind-the-scenes, and the LogWrite method no longer has
+//   return values.
 //
 // Future work: (please let me know if you think I should work on any of these particularly)
 // - Log file rotation
 // - Logging configuration files ala log4j
-// - Have the ability to remove filters?
 // - Have GetInfoChannel, GetDebugChannel, etc return a chan string that allows
 //   for another method of logging
 // - Add an XML filter type
 package log4go
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
-	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -83,11 +107,17 @@ var (
 	levelStrings = [...]string{"FNST", "FINE", "DEBG", "TRAC", "INFO", "WARN", "EROR", "CRIT"}
 )
 
+// String returns the short name of the level, such as "WARN" (see also Name).
 func (l Level) String() string {
-	if l < 0 || int(l) > len(levelStrings) {
-		return "UNKNOWN"
+	if l >= 0 && int(l) < len(levelStrings) {
+		return levelStrings[int(l)]
+	}
+	if table := loadLevels(); table != nil {
+		if names, ok := table.names[l]; ok {
+			return names[1]
+		}
 	}
-	return levelStrings[int(l)]
+	return "UNKNOWN"
 }
 
 /****** Variables ******/
@@ -101,10 +131,21 @@ var (
 
 // A LogRecord contains all of the pertinent information for each message
 type LogRecord struct {
-	Level   Level     // The log level
-	Created time.Time // The time at which the log message was created (nanoseconds)
-	Source  string    // The message source
-	Message string    // The log message
+	Level    Level     // The log level
+	Created  time.Time // The time at which the log message was created (nanoseconds)
+	Source   string    // The message source
+	Message  string    // The log message
+	Fields   Fields    `json:",omitempty"` // Structured key/value fields
+	TraceID  string    `json:",omitempty"` // W3C trace ID from the logging context
+	SpanID   string    `json:",omitempty"` // W3C span (parent) ID from the logging context
+	Category string    `json:",omitempty"` // The name of the logger (see GetLogger)
+	Func     string    `json:",omitempty"` // The calling function, if known
+	File     string    `json:",omitempty"` // The path of the calling source file, if known
+	Line     int       `json:",omitempty"` // The line in File, if known
+	Stack    string    `json:",omitempty"` // The stack of the caller (see SetStackTrace)
+
+	refs   int32 // references held to a pooled record; accessed atomically
+	pooled bool  // whether the record goes back to the pool (see release)
 }
 
 /****** LogWriter ******/
@@ -119,87 +160,515 @@ type LogWriter interface {
 	Close()
 }
 
+// A ContextCloser is a LogWriter whose closing can be bounded in time and can
+// fail (see Logger.CloseContext).  The writers of this package are
+// ContextClosers.
+type ContextCloser interface {
+	// CloseContext closes the LogWriter like Close, but gives up waiting for
+	// it when ctx is done, and returns the error of closing it, if any.
+	CloseContext(ctx context.Context) error
+}
+
+// A Flusher is a LogWriter which can wait until the records given to it have
+// been written (see Logger.Flush).  The writers of this package are Flushers.
+type Flusher interface {
+	// Flush returns once the records given to LogWrite before the call have
+	// been written, or with the error of ctx once it is done.
+	Flush(ctx context.Context) error
+}
+
+// An ErrorReporter is a LogWriter which passes its failures to an ErrorHandler
+// (see Logger.SetErrorHandler).  The writers of this package are
+// ErrorReporters.
+type ErrorReporter interface {
+	// SetErrorHandler sets the handler of the failures of the LogWriter; nil
+	// means DefaultErrorHandler.
+	SetErrorHandler(h ErrorHandler)
+}
+
 /****** Logger ******/
 
 // A Filter represents the log level below which no log records are written to
-// the associated LogWriter.
+// the associated LogWriter.  The level may be changed with SetLevel while the
+// logger is in use.  A Filter may also sample and rate limit the records it
+// writes (see SetLimits).
 type Filter struct {
-	Level Level
+	level int32 // accessed atomically
 	LogWriter
+
+	hier    *hierarchy            // the loggers the filter belongs to, if any
+	limiter atomicValue[*limiter] // see SetLimits
+	writes  sync.WaitGroup        // the log calls writing to the filter
 }
 
-// A Logger represents a collection of Filters through which log messages are
-// written.
-type Logger map[string]*Filter
+// Level returns the level below which the filter discards records.
+func (filt *Filter) Level() Level {
+	return Level(atomic.LoadInt32(&filt.level))
+}
+
+// SetLevel changes the level below which the filter discards records.  It is
+// safe to call while messages are being logged.
+func (filt *Filter) SetLevel(lvl Level) {
+	if filt.hier == nil {
+		atomic.StoreInt32(&filt.level, int32(lvl))
+		return
+	}
+	filt.hier.mu.Lock()
+	defer filt.hier.mu.Unlock()
+	atomic.StoreInt32(&filt.level, int32(lvl))
+	filt.hier.updateLevels()
+}
 
-// Create a new logger.
+// Close waits for the log calls writing to the filter, writes the final report
+// of its limits, if any, and closes its LogWriter.
+func (filt *Filter) Close() {
+	filt.CloseContext(context.Background())
+}
+
+// CloseContext closes the filter like Close, using the CloseContext method of
+// its LogWriter if it is a ContextCloser.
+func (filt *Filter) CloseContext(ctx context.Context) error {
+	filt.writes.Wait()
+	filt.report(filt.limiter.Load())
+	if cc, ok := filt.LogWriter.(ContextCloser); ok {
+		return cc.CloseContext(ctx)
+	}
+	filt.LogWriter.Close()
+	return nil
+}
+
+// Pass the failures of the LogWriter, if it is an ErrorReporter, to h with the
+// given tag
+func (filt *Filter) setErrorHandler(tag string, h ErrorHandler) {
+	if r, ok := filt.LogWriter.(ErrorReporter); ok {
+		if h != nil {
+			h = tagErrors(tag, h)
+		}
+		r.SetErrorHandler(h)
+	}
+}
+
+// A Logger represents a collection of Filters through which log messages are
+// written.  Child loggers created with With share the filters of their parent
+// and add their fields to every record.  Named loggers obtained from GetLogger
+// have filters of their own and also write to those of their ancestors.
 //
-// DEPRECATED: Use make(Logger) instead.
-func NewLogger() Logger {
-	os.Stderr.WriteString("warning: use of deprecated NewLogger\n")
-	return make(Logger)
+// A Logger is safe for use by multiple goroutines, including while its filters
+// are being added, removed or replaced.
+type Logger struct {
+	cat    *category
+	fields Fields
+	skip   int // additional stack frames above the caller (see WithCallerSkip)
+}
+
+// Create a new logger with no filters.  The logger is the root of its own
+// hierarchy of named loggers (see GetLogger).
+func NewLogger() *Logger {
+	return &Logger{cat: newHierarchy()}
 }
 
 // Create a new logger with a "stdout" filter configured to send log messages at
 // or above lvl to standard output.
 //
 // DEPRECATED: use NewDefaultLogger instead.
-func NewConsoleLogger(lvl Level) Logger {
+func NewConsoleLogger(lvl Level) *Logger {
 	os.Stderr.WriteString("warning: use of deprecated NewConsoleLogger\n")
-	return Logger{
-		"stdout": &Filter{lvl, NewConsoleLogWriter()},
-	}
+	return NewDefaultLogger(lvl)
 }
 
 // Create a new logger with a "stdout" filter configured to send log messages at
 // or above lvl to standard output.
-func NewDefaultLogger(lvl Level) Logger {
-	return Logger{
-		"stdout": &Filter{lvl, NewConsoleLogWriter()},
-	}
+func NewDefaultLogger(lvl Level) *Logger {
+	return NewLogger().AddFilter("stdout", lvl, NewConsoleLogWriter())
 }
 
 // Closes all log writers in preparation for exiting the program or a
 // reconfiguration of logging.  Calling this is not really imperative, unless
 // you want to guarantee that all log messages are written.  Close removes
-// all filters (and thus all LogWriters) from the logger.
-func (log Logger) Close() {
+// all filters (and thus all LogWriters) from the logger.  Closing the root
+// logger closes the filters of every named logger in its hierarchy.
+func (log *Logger) Close() {
+	log.CloseContext(context.Background())
+}
+
+// CloseContext closes the log writers like Close, all at once, and waits until
+// they are closed or ctx is done.  It returns the errors of closing them, and
+// ctx.Err() for those which did not close in time, as one error.
+func (log *Logger) CloseContext(ctx context.Context) error {
+	hier := log.cat.hier
+	hier.mu.Lock()
+	root := log.cat.parent == nil
+	closing := make(map[*Filter]bool)
+	for _, cat := range hier.categories {
+		if !root && cat != log.cat {
+			continue
+		}
+		for _, filt := range cat.filters {
+			closing[filt] = true
+		}
+		cat.filters = make(map[string]*Filter)
+	}
+	// Filters shared with other loggers (see LoadConfiguration) go too
+	for _, cat := range hier.categories {
+		for name, filt := range cat.filters {
+			if closing[filt] {
+				delete(cat.filters, name)
+			}
+		}
+	}
+	hier.updateLevels()
+	hier.mu.Unlock()
+
 	// Close all open loggers
-	for name, filt := range log {
-		filt.Close()
-		delete(log, name)
+	var wg sync.WaitGroup
+	errs := make(chan error, len(closing))
+	for filt := range closing {
+		wg.Add(1)
+		go func(filt *Filter) {
+			defer wg.Done()
+			errs <- filt.CloseContext(ctx)
+		}(filt)
 	}
+	wg.Wait()
+	close(errs)
+
+	var failed multiError
+	for err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return failed
+}
+
+// multiError holds the errors of several writers.
+type multiError []error
+
+func (errs multiError) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap lets errors.Is and errors.As look at each error.
+func (errs multiError) Unwrap() []error {
+	return errs
+}
+
+// Flush waits until every writer which the records of the logger go to, and
+// which is a Flusher, has written the records given to it before the call.  It
+// gives up when ctx is done.  Flushing the root logger flushes the writers of
+// every named logger in its hierarchy.  It returns the first error of any
+// writer.
+func (log *Logger) Flush(ctx context.Context) error {
+	hier := log.cat.hier
+	hier.mu.RLock()
+	var flushers []Flusher
+	seen := make(map[*Filter]bool)
+	add := func(cat *category) {
+		for _, filt := range cat.filters {
+			if f, ok := filt.LogWriter.(Flusher); ok && !seen[filt] {
+				flushers = append(flushers, f)
+			}
+			seen[filt] = true
+		}
+	}
+	if log.cat.parent == nil {
+		for _, cat := range hier.categories {
+			add(cat)
+		}
+	} else {
+		for cat := log.cat; cat != nil; cat = cat.parent {
+			add(cat)
+			if !cat.additive {
+				break
+			}
+		}
+	}
+	hier.mu.RUnlock()
+
+	var first error
+	for _, f := range flushers {
+		if err := f.Flush(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
 }
 
 // Add a new LogWriter to the Logger which will only log messages at lvl or
-// higher.  This function should not be called from multiple goroutines.
+// higher.  A filter already registered under name is replaced as if by
+// ReplaceFilter.  A nil writer, as constructors which fail return, is ignored.
 // Returns the logger for chaining.
-func (log Logger) AddFilter(name string, lvl Level, writer LogWriter) Logger {
-	log[name] = &Filter{lvl, writer}
+func (log *Logger) AddFilter(name string, lvl Level, writer LogWriter) *Logger {
+	if writer == nil {
+		return log
+	}
+	log.ReplaceFilter(name, lvl, writer)
 	return log
 }
 
+// ReplaceFilter installs writer under name, logging messages at lvl or higher,
+// and reports whether it replaced an existing filter.  The swap is atomic: each
+// record goes either to the old writer or to the new one.  The old writer is
+// closed once no log call is using it, after it has written what it has queued.
+func (log *Logger) ReplaceFilter(name string, lvl Level, writer LogWriter) bool {
+	return log.replaceFilter(name, &Filter{level: int32(lvl), LogWriter: writer})
+}
+
+func (log *Logger) replaceFilter(name string, filt *Filter) bool {
+	hier := log.cat.hier
+	hier.mu.Lock()
+	filt.hier = hier
+	if h := hier.handler.Load(); h != nil {
+		filt.setErrorHandler(name, h)
+	}
+	old, ok := log.cat.filters[name]
+	log.cat.filters[name] = filt
+	hier.updateLevels()
+	hier.mu.Unlock()
+
+	if ok && old.LogWriter != filt.LogWriter {
+		old.Close()
+	}
+	return ok
+}
+
+// RemoveFilter removes the filter registered under name and closes its writer,
+// letting it write the records it has queued.  It reports whether the filter
+// existed.
+func (log *Logger) RemoveFilter(name string) bool {
+	hier := log.cat.hier
+	hier.mu.Lock()
+	old, ok := log.cat.filters[name]
+	delete(log.cat.filters, name)
+	hier.updateLevels()
+	hier.mu.Unlock()
+
+	if ok {
+		old.Close()
+	}
+	return ok
+}
+
+// SetErrorHandler passes the failures of the writers of every logger in the
+// hierarchy of the logger (see GetLogger) to h, tagged with the names of their
+// filters, including writers added later.  The writers must be ErrorReporters.
+// A nil handler restores DefaultErrorHandler.  The first handler set on the
+// hierarchy is also passed the error in LOG4GO_VMODULE, if it is invalid (see
+// VModuleEnvError), as the failure to parse it.
+func (log *Logger) SetErrorHandler(h ErrorHandler) {
+	hier := log.cat.hier
+	hier.mu.Lock()
+	hier.handler.Store(h)
+	for _, cat := range hier.categories {
+		for name, filt := range cat.filters {
+			filt.setErrorHandler(name, h)
+		}
+	}
+	report := h != nil && !hier.envReported
+	if report {
+		hier.envReported = true
+	}
+	hier.mu.Unlock()
+
+	// Outside the lock, as the handler may log
+	if err := VModuleEnvError(); report && err != nil {
+		h(&WriterError{Writer: VModuleEnv, Op: "parse", Err: errors.Unwrap(err)})
+	}
+}
+
+// SetLevel changes the level of the filter registered under name and reports
+// whether the filter exists.  It is safe to call while messages are being
+// logged.
+func (log *Logger) SetLevel(name string, lvl Level) bool {
+	hier := log.cat.hier
+	hier.mu.Lock()
+	defer hier.mu.Unlock()
+	filt, ok := log.cat.filters[name]
+	if !ok {
+		return false
+	}
+	atomic.StoreInt32(&filt.level, int32(lvl))
+	hier.updateLevels()
+	return true
+}
+
+// SetThreshold sets a logger-wide level below which messages are discarded,
+// whatever the levels of the filters.  Named loggers without a threshold of
+// their own inherit that of their nearest ancestor.  It is safe to call while
+// messages are being logged.
+func (log *Logger) SetThreshold(lvl Level) {
+	log.setThreshold(int32(lvl))
+}
+
+// ClearThreshold removes the threshold set by SetThreshold, so that the logger
+// inherits the threshold of its parent again.
+func (log *Logger) ClearThreshold() {
+	log.setThreshold(noThreshold)
+}
+
+func (log *Logger) setThreshold(lvl int32) {
+	hier := log.cat.hier
+	hier.mu.Lock()
+	defer hier.mu.Unlock()
+	atomic.StoreInt32(&log.cat.threshold, lvl)
+	hier.updateLevels()
+}
+
+// Threshold returns the effective threshold of the logger: its own, or else
+// that of its nearest ancestor which has one.  A logger without a threshold
+// reports the lowest possible level.
+func (log *Logger) Threshold() Level {
+	return Level(atomic.LoadInt32(&log.cat.effective))
+}
+
+// Filters returns a snapshot of the logger's own filters, keyed by name.
+func (log *Logger) Filters() map[string]*Filter {
+	log.cat.hier.mu.RLock()
+	defer log.cat.hier.mu.RUnlock()
+
+	filters := make(map[string]*Filter, len(log.cat.filters))
+	for name, filt := range log.cat.filters {
+		filters[name] = filt
+	}
+	return filters
+}
+
+// With returns a child logger which writes to the same filters as log and
+// attaches the given fields, after any fields of log itself, to every record.
+func (log *Logger) With(fields ...Field) *Logger {
+	child := &Logger{
+		cat:    log.cat,
+		fields: make(Fields, 0, len(log.fields)+len(fields)),
+		skip:   log.skip,
+	}
+	child.fields = append(child.fields, log.fields...)
+	child.fields = append(child.fields, fields...)
+	return child
+}
+
+// WithCallerSkip returns a child logger which writes to the same filters as
+// log but skips n more stack frames when determining the source of a message.
+// This lets a function which wraps the logging methods report its own caller
+// as the source instead of itself.
+func (log *Logger) WithCallerSkip(n int) *Logger {
+	child := *log
+	child.skip += n
+	return &child
+}
+
 /******* Logging *******/
-// Send a formatted log message internally
-func (log Logger) intLogf(lvl Level, format string, args ...interface{}) {
-	skip := true
+// Build a log record stamped with the logger's fields and with the fields and
+// trace of ctx, which may be nil.  The record comes from the pool (see
+// dispatch).
+func (log *Logger) newRecord(ctx context.Context, lvl Level, src, msg string) *LogRecord {
+	rec := getRecord()
+	rec.Level = lvl
+	rec.Created = time.Now()
+	rec.Source = src
+	rec.Message = msg
+	rec.Fields = log.fields
+	rec.Category = log.cat.name
+	if ctx != nil {
+		if fields := FieldsFromContext(ctx); len(fields) > 0 {
+			rec.Fields = make(Fields, 0, len(log.fields)+len(fields))
+			rec.Fields = append(rec.Fields, log.fields...)
+			rec.Fields = append(rec.Fields, fields...)
+		}
+		rec.TraceID, rec.SpanID = TraceFromContext(ctx)
+	}
+	return rec
+}
 
-	// Determine if any logging will be done
-	for _, filt := range log {
-		if lvl >= filt.Level {
-			skip = false
+// Report whether any filter could write a message at lvl from some caller
+func (log *Logger) enabled(lvl Level) bool {
+	return int32(lvl) >= atomic.LoadInt32(&log.cat.minLevel)
+}
+
+// Decide whether a message at lvl from the code at pc (zero if unknown) is
+// written, and whether a per-source override applies to it instead of the
+// levels of the filters (see SetVModule)
+func (log *Logger) admit(lvl Level, pc uintptr) (write, override bool) {
+	if vm := log.cat.hier.vmodule.Load(); vm != nil && pc != 0 {
+		if min, ok := vm.levelFor(pc); ok {
+			return lvl >= min, true
+		}
+	}
+	return int32(lvl) >= atomic.LoadInt32(&log.cat.baseLevel), false
+}
+
+// Write rec to every filter of the logger, and of its ancestors as long as
+// they are additive, which accepts its level.  When override is set, the
+// record has already passed a per-source level and goes to every filter.  The
+// reference of the caller to rec is released.
+func (log *Logger) dispatch(rec *LogRecord, override bool) {
+	defer rec.release()
+	hier := log.cat.hier
+	hier.mu.RLock()
+	if !override && int32(rec.Level) < atomic.LoadInt32(&log.cat.effective) {
+		hier.mu.RUnlock()
+		return
+	}
+	var buf [8]*Filter
+	filts := log.appendFilters(buf[:0], rec.Level, override)
+	for _, filt := range filts {
+		filt.writes.Add(1)
+	}
+	hier.mu.RUnlock()
+
+	// The record is reused only if every writer releases it
+	reuse := rec.pooled
+	for _, filt := range filts {
+		if _, ok := filt.LogWriter.(recordReleaser); !ok {
+			reuse = false
+		}
+	}
+	if reuse {
+		rec.retain(int32(len(filts)))
+	} else {
+		rec.pooled = false
+	}
+	for _, filt := range filts {
+		filt.LogWrite(rec)
+		filt.writes.Done()
+	}
+}
+
+// Append every filter a record at lvl goes to (see dispatch) to filts.  Must
+// be called with the read lock held.
+func (log *Logger) appendFilters(filts []*Filter, lvl Level, override bool) []*Filter {
+	for cat := log.cat; cat != nil; cat = cat.parent {
+		for _, filt := range cat.filters {
+			if !override && lvl < filt.Level() {
+				continue
+			}
+			filts = append(filts, filt)
+		}
+		if !cat.additive {
 			break
 		}
 	}
-	if skip {
+	return filts
+}
+
+// Send a formatted log message internally
+func (log *Logger) intLogf(ctx context.Context, lvl Level, format string, args ...interface{}) {
+	// Determine if any logging will be done
+	if !log.enabled(lvl) {
 		return
 	}
 
 	// Determine caller func
-	pc, _, lineno, ok := runtime.Caller(2)
-	src := ""
-	if ok {
-		src = fmt.Sprintf("%s:%d", runtime.FuncForPC(pc).Name(), lineno)
+	site := lookupCaller(2 + log.skip)
+	write, override := log.admit(lvl, site.pc)
+	if !write {
+		return
 	}
 
 	msg := format
@@ -208,277 +677,364 @@ func (log Logger) intLogf(lvl Level, format string, args ...interface{}) {
 	}
 
 	// Make the log record
-	rec := &LogRecord{
-		Level:   lvl,
-		Created: time.Now(),
-		Source:  src,
-		Message: msg,
-	}
+	rec := log.newRecord(ctx, lvl, site.src, msg)
+	rec.Func, rec.File, rec.Line = site.fn, site.file, site.line
+	rec.Stack = log.stackFor(lvl, 2+log.skip)
 
 	// Dispatch the logs
-	for _, filt := range log {
-		if lvl < filt.Level {
-			continue
-		}
-		filt.LogWrite(rec)
-	}
+	log.dispatch(rec, override)
 }
 
 // Send a closure log message internally
-func (log Logger) intLogc(lvl Level, closure func() string) {
-	skip := true
-
+func (log *Logger) intLogc(ctx context.Context, lvl Level, closure func() string) {
 	// Determine if any logging will be done
-	for _, filt := range log {
-		if lvl >= filt.Level {
-			skip = false
-			break
-		}
-	}
-	if skip {
+	if !log.enabled(lvl) {
 		return
 	}
 
 	// Determine caller func
-	pc, _, lineno, ok := runtime.Caller(2)
-	src := ""
-	if ok {
-		src = fmt.Sprintf("%s:%d", runtime.FuncForPC(pc).Name(), lineno)
+	site := lookupCaller(2 + log.skip)
+	write, override := log.admit(lvl, site.pc)
+	if !write {
+		return
 	}
 
 	// Make the log record
-	rec := &LogRecord{
-		Level:   lvl,
-		Created: time.Now(),
-		Source:  src,
-		Message: closure(),
-	}
+	rec := log.newRecord(ctx, lvl, site.src, closure())
+	rec.Func, rec.File, rec.Line = site.fn, site.file, site.line
+	rec.Stack = log.stackFor(lvl, 2+log.skip)
 
 	// Dispatch the logs
-	for _, filt := range log {
-		if lvl < filt.Level {
-			continue
-		}
-		filt.LogWrite(rec)
-	}
+	log.dispatch(rec, override)
 }
 
 // Send a log message with manual level, source, and message.
-func (log Logger) Log(lvl Level, source, message string) {
-	skip := true
-
+func (log *Logger) Log(lvl Level, source, message string) {
 	// Determine if any logging will be done
-	for _, filt := range log {
-		if lvl >= filt.Level {
-			skip = false
-			break
-		}
-	}
-	if skip {
+	write, override := log.admit(lvl, 0)
+	if !write {
 		return
 	}
 
 	// Make the log record
-	rec := &LogRecord{
-		Level:   lvl,
-		Created: time.Now(),
-		Source:  source,
-		Message: message,
-	}
+	rec := log.newRecord(nil, lvl, source, message)
+	rec.Stack = log.stackFor(lvl, 1)
 
 	// Dispatch the logs
-	for _, filt := range log {
-		if lvl < filt.Level {
-			continue
-		}
-		filt.LogWrite(rec)
-	}
+	log.dispatch(rec, override)
 }
 
 // Logf logs a formatted log message at the given log level, using the caller as
 // its source.
-func (log Logger) Logf(lvl Level, format string, args ...interface{}) {
-	log.intLogf(lvl, format, args...)
+func (log *Logger) Logf(lvl Level, format string, args ...interface{}) {
+	log.intLogf(nil, lvl, format, args...)
 }
 
 // Logc logs a string returned by the closure at the given log level, using the caller as
 // its source.  If no log message would be written, the closure is never called.
-func (log Logger) Logc(lvl Level, closure func() string) {
-	log.intLogc(lvl, closure)
+func (log *Logger) Logc(lvl Level, closure func() string) {
+	log.intLogc(nil, lvl, closure)
+}
+
+// LogCtx logs a formatted log message at the given log level, using the caller
+// as its source.  The record carries the fields and trace attached to ctx.
+func (log *Logger) LogCtx(ctx context.Context, lvl Level, format string, args ...interface{}) {
+	log.intLogf(ctx, lvl, format, args...)
 }
 
 // Finest logs a message at the finest log level.
 // See Debug for an explanation of the arguments.
-func (log Logger) Finest(arg0 interface{}, args ...interface{}) {
+func (log *Logger) Finest(arg0 interface{}, args ...interface{}) {
 	const (
 		lvl = FINEST
 	)
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		log.intLogf(lvl, first, args...)
+		log.intLogf(nil, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		log.intLogc(lvl, first)
+		log.intLogc(nil, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		log.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+		log.intLogf(nil, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
 }
 
 // Fine logs a message at the fine log level.
 // See Debug for an explanation of the arguments.
-func (log Logger) Fine(arg0 interface{}, args ...interface{}) {
+func (log *Logger) Fine(arg0 interface{}, args ...interface{}) {
 	const (
 		lvl = FINE
 	)
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		log.intLogf(lvl, first, args...)
+		log.intLogf(nil, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		log.intLogc(lvl, first)
+		log.intLogc(nil, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		log.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+		log.intLogf(nil, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
 }
 
 // Debug is a utility method for debug log messages.
 // The behavior of Debug depends on the first argument:
-// - arg0 is a string
-//   When given a string as the first argument, this behaves like Logf but with
-//   the DEBUG log level: the first argument is interpreted as a format for the
-//   latter arguments.
-// - arg0 is a func()string
-//   When given a closure of type func()string, this logs the string returned by
-//   the closure iff it will be logged.  The closure runs at most one time.
-// - arg0 is interface{}
-//   When given anything else, the log message will be each of the arguments
-//   formatted with %v and separated by spaces (ala Sprint).
-func (log Logger) Debug(arg0 interface{}, args ...interface{}) {
+//   - arg0 is a string
+//     When given a string as the first argument, this behaves like Logf but with
+//     the DEBUG log level: the first argument is interpreted as a format for the
+//     latter arguments.
+//   - arg0 is a func()string
+//     When given a closure of type func()string, this logs the string returned by
+//     the closure iff it will be logged.  The closure runs at most one time.
+//   - arg0 is interface{}
+//     When given anything else, the log message will be each of the arguments
+//     formatted with %v and separated by spaces (ala Sprint).
+func (log *Logger) Debug(arg0 interface{}, args ...interface{}) {
 	const (
 		lvl = DEBUG
 	)
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		log.intLogf(lvl, first, args...)
+		log.intLogf(nil, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		log.intLogc(lvl, first)
+		log.intLogc(nil, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		log.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+		log.intLogf(nil, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
 }
 
 // Trace logs a message at the trace log level.
 // See Debug for an explanation of the arguments.
-func (log Logger) Trace(arg0 interface{}, args ...interface{}) {
+func (log *Logger) Trace(arg0 interface{}, args ...interface{}) {
 	const (
 		lvl = TRACE
 	)
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		log.intLogf(lvl, first, args...)
+		log.intLogf(nil, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		log.intLogc(lvl, first)
+		log.intLogc(nil, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		log.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+		log.intLogf(nil, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
 }
 
 // Info logs a message at the info log level.
 // See Debug for an explanation of the arguments.
-func (log Logger) Info(arg0 interface{}, args ...interface{}) {
+func (log *Logger) Info(arg0 interface{}, args ...interface{}) {
 	const (
 		lvl = INFO
 	)
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		log.intLogf(lvl, first, args...)
+		log.intLogf(nil, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		log.intLogc(lvl, first)
+		log.intLogc(nil, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		log.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+		log.intLogf(nil, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+	}
+}
+
+// Build the error returned by Warn, Error and Critical.  A format string may
+// wrap errors with %w, and an error given in place of one is wrapped itself, so
+// that errors.Is and errors.As see through the result.
+func makeError(arg0 interface{}, args []interface{}) error {
+	switch first := arg0.(type) {
+	case string:
+		if len(args) == 0 {
+			// Logged as it is, like the message
+			return errors.New(first)
+		}
+		return fmt.Errorf(first, args...)
+	case func() string:
+		return errors.New(first())
+	case error:
+		return fmt.Errorf("%w"+strings.Repeat(" %v", len(args)), append([]interface{}{first}, args...)...)
 	}
+	if len(args) == 0 {
+		return errors.New(fmt.Sprint(arg0))
+	}
+	return fmt.Errorf(fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 }
 
 // Warn logs a message at the warning log level and returns the formatted error.
 // At the warning level and higher, there is no performance benefit if the
 // message is not actually logged, because all formats are processed and all
-// closures are executed to format the error message.
+// closures are executed to format the error message.  The format may wrap
+// errors with %w, which the returned error then wraps in turn.
 // See Debug for further explanation of the arguments.
-func (log Logger) Warn(arg0 interface{}, args ...interface{}) error {
+func (log *Logger) Warn(arg0 interface{}, args ...interface{}) error {
 	const (
 		lvl = WARNING
 	)
-	var msg string
+	err := makeError(arg0, args)
+	log.intLogf(nil, lvl, "%s", err.Error())
+	return err
+}
+
+// Error logs a message at the error log level and returns the formatted error,
+// See Warn for an explanation of the performance and Debug for an explanation
+// of the parameters.
+func (log *Logger) Error(arg0 interface{}, args ...interface{}) error {
+	const (
+		lvl = ERROR
+	)
+	err := makeError(arg0, args)
+	log.intLogf(nil, lvl, "%s", err.Error())
+	return err
+}
+
+// Critical logs a message at the critical log level and returns the formatted error,
+// See Warn for an explanation of the performance and Debug for an explanation
+// of the parameters.
+func (log *Logger) Critical(arg0 interface{}, args ...interface{}) error {
+	const (
+		lvl = CRITICAL
+	)
+	err := makeError(arg0, args)
+	log.intLogf(nil, lvl, "%s", err.Error())
+	return err
+}
+
+// FinestCtx logs a message at the finest log level with the fields and trace
+// attached to ctx.  See Debug for an explanation of the other arguments.
+func (log *Logger) FinestCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	const (
+		lvl = FINEST
+	)
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		msg = fmt.Sprintf(first, args...)
+		log.intLogf(ctx, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		msg = first()
+		log.intLogc(ctx, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		msg = fmt.Sprintf(fmt.Sprint(first)+strings.Repeat(" %v", len(args)), args...)
+		log.intLogf(ctx, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
-	log.intLogf(lvl, msg)
-	return errors.New(msg)
 }
 
-// Error logs a message at the error log level and returns the formatted error,
-// See Warn for an explanation of the performance and Debug for an explanation
-// of the parameters.
-func (log Logger) Error(arg0 interface{}, args ...interface{}) error {
+// FineCtx logs a message at the fine log level with the fields and trace
+// attached to ctx.  See Debug for an explanation of the other arguments.
+func (log *Logger) FineCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
 	const (
-		lvl = ERROR
+		lvl = FINE
 	)
-	var msg string
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		msg = fmt.Sprintf(first, args...)
+		log.intLogf(ctx, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		msg = first()
+		log.intLogc(ctx, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		msg = fmt.Sprintf(fmt.Sprint(first)+strings.Repeat(" %v", len(args)), args...)
+		log.intLogf(ctx, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
-	log.intLogf(lvl, msg)
-	return errors.New(msg)
 }
 
-// Critical logs a message at the critical log level and returns the formatted error,
-// See Warn for an explanation of the performance and Debug for an explanation
-// of the parameters.
-func (log Logger) Critical(arg0 interface{}, args ...interface{}) error {
+// DebugCtx logs a message at the debug log level with the fields and trace
+// attached to ctx.  See Debug for an explanation of the other arguments.
+func (log *Logger) DebugCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
 	const (
-		lvl = CRITICAL
+		lvl = DEBUG
+	)
+	switch first := arg0.(type) {
+	case string:
+		// Use the string as a format string
+		log.intLogf(ctx, lvl, first, args...)
+	case func() string:
+		// Log the closure (no other arguments used)
+		log.intLogc(ctx, lvl, first)
+	default:
+		// Build a format string so that it will be similar to Sprint
+		log.intLogf(ctx, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+	}
+}
+
+// TraceCtx logs a message at the trace log level with the fields and trace
+// attached to ctx.  See Debug for an explanation of the other arguments.
+func (log *Logger) TraceCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	const (
+		lvl = TRACE
+	)
+	switch first := arg0.(type) {
+	case string:
+		// Use the string as a format string
+		log.intLogf(ctx, lvl, first, args...)
+	case func() string:
+		// Log the closure (no other arguments used)
+		log.intLogc(ctx, lvl, first)
+	default:
+		// Build a format string so that it will be similar to Sprint
+		log.intLogf(ctx, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+	}
+}
+
+// InfoCtx logs a message at the info log level with the fields and trace
+// attached to ctx.  See Debug for an explanation of the other arguments.
+func (log *Logger) InfoCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	const (
+		lvl = INFO
 	)
-	var msg string
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		msg = fmt.Sprintf(first, args...)
+		log.intLogf(ctx, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		msg = first()
+		log.intLogc(ctx, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		msg = fmt.Sprintf(fmt.Sprint(first)+strings.Repeat(" %v", len(args)), args...)
+		log.intLogf(ctx, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
-	log.intLogf(lvl, msg)
-	return errors.New(msg)
+}
+
+// WarnCtx logs a message at the warning log level with the fields and trace
+// attached to ctx and returns the formatted error.  See Warn for an explanation
+// of the performance and Debug for an explanation of the other arguments.
+func (log *Logger) WarnCtx(ctx context.Context, arg0 interface{}, args ...interface{}) error {
+	const (
+		lvl = WARNING
+	)
+	err := makeError(arg0, args)
+	log.intLogf(ctx, lvl, "%s", err.Error())
+	return err
+}
+
+// ErrorCtx logs a message at the error log level with the fields and trace
+// attached to ctx and returns the formatted error.  See Warn for an explanation
+// of the performance and Debug for an explanation of the other arguments.
+func (log *Logger) ErrorCtx(ctx context.Context, arg0 interface{}, args ...interface{}) error {
+	const (
+		lvl = ERROR
+	)
+	err := makeError(arg0, args)
+	log.intLogf(ctx, lvl, "%s", err.Error())
+	return err
+}
+
+// CriticalCtx logs a message at the critical log level with the fields and trace
+// attached to ctx and returns the formatted error.  See Warn for an explanation
+// of the performance and Debug for an explanation of the other arguments.
+func (log *Logger) CriticalCtx(ctx context.Context, arg0 interface{}, args ...interface{}) error {
+	const (
+		lvl = CRITICAL
+	)
+	err := makeError(arg0, args)
+	log.intLogf(ctx, lvl, "%s", err.Error())
+	return err
 }
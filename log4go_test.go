@@ -3,13 +3,24 @@
 package log4go
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -61,6 +72,59 @@ var formatTests = []struct {
 			FORMAT_ABBREV:  "[EROR] message\n",
 		},
 	},
+	{
+		Test: "Fields",
+		Record: &LogRecord{
+			Level:   INFO,
+			Source:  "source",
+			Message: "message",
+			Created: now,
+			Fields:  Fields{String("user", "kyle"), Int("shard", 3), Bool("retry", false)},
+		},
+		Formats: map[string]string{
+			"[%L] %M %X":                 "[INFO] message user=kyle shard=3 retry=false\n",
+			"[%L] %X{user}/%X{shard} %M": "[INFO] kyle/3 message\n",
+			"[%L] %X{missing}%M":         "[INFO] message\n",
+		},
+	},
+	{
+		Test: "Time formats",
+		Record: &LogRecord{
+			Level:   INFO,
+			Source:  "source",
+			Message: "message",
+			Created: now,
+		},
+		Formats: map[string]string{
+			"%D %T.%q %M":                           "2009/02/13 23:31:30 UTC.123 message\n",
+			"%t:%u %d":                              "23:31:123456 13/02/09\n",
+			"%N":                                    "123456789\n",
+			"%Y":                                    "2009-02-13T23:31:30.123Z\n",
+			"%e %E":                                 "1234567890 1234567890123\n",
+			"%{2006-01-02 15:04:05.000000 MST}T %M": "2009-02-13 23:31:30.123456 UTC message\n",
+			"%{RFC3339Nano}T|%{Kitchen}T":           "2009-02-13T23:31:30.123456789Z|11:31PM\n",
+			"%{15:04:05,999}T %{.00}T":              "23:31:30,123 .12\n",
+			"%{05.000 .000000 MST}T":                "30.123 .123456 UTC\n",
+		},
+	},
+	{
+		Test: "Modifiers",
+		Record: &LogRecord{
+			Level:    WARNING,
+			Source:   "github.com/user/pkg.(*Server).handle:42",
+			Message:  "héllo",
+			Created:  now,
+			Category: "app",
+		},
+		Formats: map[string]string{
+			"[%-8l] [%8l] %M":        "[WARNING ] [ WARNING] héllo\n",
+			"%.12S|%.-10S":           "r).handle:42|github.com\n",
+			"%22.20S|%-6.6c|":        "  .(*Server).handle:42|app   |\n",
+			"%3M|%.3M|%.-3M|%-7M|":   "héllo|llo|hél|héllo  |\n",
+			"%-14{15:04:05.000}T|%e": "23:31:30.123  |1234567890\n",
+			"%2L|%.0M|":              "WARN|héllo|\n",
+		},
+	},
 }
 
 func TestFormatLogRecord(t *testing.T) {
@@ -76,6 +140,242 @@ func TestFormatLogRecord(t *testing.T) {
 	}
 }
 
+func TestCompileFormat(t *testing.T) {
+	// Compiled formats format records as FormatLogRecord does
+	for _, test := range formatTests {
+		for format, want := range test.Formats {
+			f, err := CompileFormat(format)
+			if err != nil {
+				t.Errorf("CompileFormat(%q): %s", format, err)
+				continue
+			}
+			if got := string(f.Format(test.Record, []byte("> "))); got != "> "+want {
+				t.Errorf("%s - %s: got %q, want %q", test.Test, format, got, "> "+want)
+			}
+			if f.String() != format {
+				t.Errorf("String: got %q, want %q", f.String(), format)
+			}
+		}
+	}
+
+	rec := newLogRecord(INFO, "source", "message")
+	for format, want := range map[string]string{
+		"100%% %M":  "100% message\n",
+		"%X{}%M":    "",
+		"%Q %M":     "",
+		"%M%":       "",
+		"%X{key %M": "",
+		"%{}T":      "",
+		"%{2006}M":  "",
+		"%{2006":    "",
+		"%.L":       "",
+		"%-5":       "",
+	} {
+		f, err := CompileFormat(format)
+		if want == "" {
+			if err == nil {
+				t.Errorf("CompileFormat(%q): expected an error", format)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("CompileFormat(%q): %s", format, err)
+		} else if got := string(f.Format(rec, nil)); got != want {
+			t.Errorf("CompileFormat(%q): got %q, want %q", format, got, want)
+		}
+	}
+
+	// Only the rest of the time is formatted once per second, for records
+	// created in the same second
+	f, _ := CompileFormat("%{05.000 .000000}T")
+	for _, ns := range []int{123456789, 987654321} {
+		rec.Created = time.Date(2009, 2, 13, 23, 31, 30, ns, time.UTC)
+		want := rec.Created.Format("05.000 .000000") + "\n"
+		if got := string(f.Format(rec, nil)); got != want {
+			t.Errorf("Format: got %q, want %q", got, want)
+		}
+	}
+
+	// Formatters may have a location of their own
+	f, _ = CompileFormat("%Y %T")
+	est := time.FixedZone("EST", -5*3600)
+	rec.Created = now.In(est)
+	if got := string(f.Format(rec, nil)); got != "2009-02-13T18:31:30.123-05:00 18:31:30 EST\n" {
+		t.Errorf("Format: got %q in the location of the record", got)
+	}
+	if got := string(f.In(time.UTC).Format(rec, nil)); got != "2009-02-13T23:31:30.123Z 23:31:30 UTC\n" {
+		t.Errorf("Format: got %q in UTC", got)
+	}
+
+	// Writers report invalid formats, and ignore what is wrong with them
+	errs := make(chan *WriterError, 1)
+	console := &ConsoleLogWriter{recordQueue: newRecordQueue(0)}
+	console.SetErrorHandler(func(err *WriterError) {
+		errs <- err
+	})
+	console.SetFormat("%Q[%L] %M")
+	if err := <-errs; err.Op != "format" {
+		t.Errorf("SetFormat: got %v, want a format error", err)
+	}
+	if got := string(console.formatter.Load().Format(rec, nil)); got != "[INFO] message\n" {
+		t.Errorf("SetFormat: got %q", got)
+	}
+}
+
+func TestFormatters(t *testing.T) {
+	rec := &LogRecord{
+		Level:    WARNING,
+		Created:  now,
+		Source:   "main.main:12",
+		Message:  "disk \"data\" is 90% full",
+		Category: "app.db",
+		Fields:   Fields{String("user", "kyle"), String("path", "/var/lib/my data"), Int("shard", 3)},
+	}
+
+	want := `ts=2009-02-13T23:31:30.123456789Z level=warning src=main.main:12 msg="disk \"data\" is 90% full" logger=app.db user=kyle path="/var/lib/my data" shard=3` + "\n"
+	if got := string(LogfmtFormatter{}.Format(rec, nil)); got != want {
+		t.Errorf("LogfmtFormatter: got %q, want %q", got, want)
+	}
+
+	want = `{"time":"2009-02-13T23:31:30.123456789Z","level":"WARNING","logger":"app.db","source":"main.main:12","msg":"disk \"data\" is 90% full","fields":{"user":"kyle","path":"/var/lib/my data","shard":3}}` + "\n"
+	if got := string(JSONFormatter{}.Format(rec, nil)); got != want {
+		t.Errorf("JSONFormatter: got %q, want %q", got, want)
+	}
+	schema := JSONFormatter{TimeKey: "@timestamp", LevelKey: "severity", TimeLayout: TimeUnixMilli, LevelStyle: LevelNumber, FlattenFields: true}
+	want = `{"@timestamp":1234567890123,"severity":5,"logger":"app.db","source":"main.main:12","msg":"disk \"data\" is 90% full","user":"kyle","path":"/var/lib/my data","shard":3}` + "\n"
+	if got := string(schema.Format(rec, nil)); got != want {
+		t.Errorf("JSONFormatter: got %q, want %q", got, want)
+	}
+	clash := &LogRecord{Created: rec.Created, Level: INFO, Source: "main", Message: "m", Fields: Fields{String("msg", "f"), Int("severity", 1), Int("level", 2), String("trace_id", "t")}}
+	wantClash := `{"@timestamp":1234567890123,"severity":4,"source":"main","msg":"m","fields.msg":"f","fields.severity":1,"level":2,"fields.trace_id":"t"}` + "\n"
+	if got := string(schema.Format(clash, nil)); got != wantClash {
+		t.Errorf("JSONFormatter: got %q, want %q", got, wantClash)
+	}
+	attrs := schema
+	attrs.FieldsKey = "attrs"
+	if got := string(attrs.Format(clash, nil)); !strings.Contains(got, `"attrs.msg":"f"`) {
+		t.Errorf("JSONFormatter: got %q, want the field msg as attrs.msg", got)
+	}
+	odd := &LogRecord{Created: rec.Created, Message: "a\tb\x01\xff<>", Fields: Fields{Float64("inf", math.Inf(1)), Err(errors.New("boom"))}}
+	js := JSONFormatter{TimeLayout: "Jan _2 \"15\""}.Format(odd, nil)
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(js, &decoded); err != nil || decoded["msg"] != "a\tb\x01\ufffd<>" || decoded["time"] != `Feb 13 "23"` || decoded["fields"].(map[string]interface{})["inf"] != "+Inf" {
+		t.Errorf("JSONFormatter: got %s (%v)", js, err)
+	}
+
+	if got := string(XMLFormatter{}.Format(rec, []byte("> "))); !strings.HasPrefix(got, "> \t<record level=\"WARN\">\n\t\t<timestamp>2009/02/13 23:31:30 UTC</timestamp>\n") {
+		t.Errorf("XMLFormatter: got %q", got)
+	}
+	traced := &LogRecord{Created: now, Message: "traced", TraceID: `a"b&<c>`, SpanID: `'&'`}
+	var parsed struct {
+		Trace struct {
+			ID   string `xml:"id,attr"`
+			Span string `xml:"span,attr"`
+		} `xml:"trace"`
+	}
+	if got := (XMLFormatter{}).Format(traced, nil); xml.Unmarshal(got, &parsed) != nil || parsed.Trace.ID != traced.TraceID || parsed.Trace.Span != traced.SpanID {
+		t.Errorf("XMLFormatter: got %q for trace %q and span %q", got, traced.TraceID, traced.SpanID)
+	}
+
+	f, ok := xmlToFormatter("test.xml", &xmlFormatter{Type: "json", TimeKey: "@timestamp", TimeLayout: "RFC3339", LevelStyle: "number", Flatten: "true"})
+	if want := (JSONFormatter{TimeKey: "@timestamp", TimeLayout: time.RFC3339, LevelStyle: LevelNumber, FlattenFields: true}); !ok || f != want {
+		t.Errorf("xmlToFormatter: got %#v, want %#v", f, want)
+	}
+
+	// Writers take any formatter
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+	w := NewSocketLogWriter("udp", conn.LocalAddr().String()).(*SocketLogWriter)
+	defer w.Close()
+	w.SetFormatter(schema)
+	w.LogWrite(rec)
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, _, err := conn.ReadFrom(buf); err != nil {
+		t.Errorf("SocketLogWriter: %s", err)
+	} else if got := string(buf[:n]); got != want {
+		t.Errorf("SocketLogWriter: got %q, want %q", got, want)
+	}
+}
+
+func TestSocketLogWriterDialError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	defer func(h ErrorHandler) {
+		DefaultErrorHandler = h
+	}(DefaultErrorHandler)
+	var reported []*WriterError
+	DefaultErrorHandler = func(err *WriterError) {
+		reported = append(reported, err)
+	}
+
+	// The writer is nil, which AddFilter leaves out
+	w := NewSocketLogWriter("tcp", addr)
+	if w != nil {
+		t.Fatalf("NewSocketLogWriter: got %#v for a closed port, want nil", w)
+	}
+	l := NewLogger().AddFilter("network", FINEST, w)
+	l.Info("dropped")
+	if len(l.Filters()) != 0 {
+		t.Errorf("AddFilter: added a nil writer")
+	}
+	if len(reported) != 1 || reported[0].Op != "dial" {
+		t.Errorf("NewSocketLogWriter: reported %v, want the dial error", reported)
+	}
+}
+
+func TestParseLogfmt(t *testing.T) {
+	rec := &LogRecord{
+		Level:    ERROR,
+		Created:  time.Unix(1234567890, 123456789).UTC(),
+		Source:   "main.main:12",
+		Message:  "line one\nline \"two\" = 2",
+		Category: "app.db",
+		TraceID:  "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanID:   "00f067aa0ba902b7",
+		Fields:   Fields{String("user", "kyle"), String("msg", "a field"), Int("shard", 3), String("bad key=", "")},
+		Stack:    "goroutine 1 [running]:\n\tmain.main()",
+	}
+	line := string(LogfmtFormatter{}.Format(rec, nil))
+	if strings.Count(line, "\n") != 1 {
+		t.Fatalf("LogfmtFormatter: got %q, want one line", line)
+	}
+	got, err := ParseLogfmt(line)
+	if err != nil {
+		t.Fatalf("ParseLogfmt(%q): %s", line, err)
+	}
+	want := *rec
+	want.Fields = Fields{String("user", "kyle"), String("msg", "a field"), String("shard", "3"), String("bad_key_", "")}
+	if !reflect.DeepEqual(got, &want) {
+		t.Errorf("ParseLogfmt(%q):\n got %#v\nwant %#v", line, got, &want)
+	}
+
+	if got, err := ParseLogfmt(`ts=2009-02-13T23:31:30Z level=warn msg=hi debug`); err != nil || got.Level != WARNING || got.Message != "hi" || len(got.Fields) != 1 || got.Fields[0] != Bool("debug", true) {
+		t.Errorf("ParseLogfmt: got %#v (%v)", got, err)
+	}
+	for _, bad := range []string{
+		`level=info msg=hi`,
+		`ts=2009-02-13T23:31:30Z msg=hi`,
+		`ts=yesterday level=info`,
+		`ts=2009-02-13T23:31:30Z level=loud`,
+		`ts=2009-02-13T23:31:30Z level=info msg="unterminated`,
+		`ts=2009-02-13T23:31:30Z level=info msg="a"b`,
+		`ts=2009-02-13T23:31:30Z level=info =x`,
+	} {
+		if _, err := ParseLogfmt(bad); err == nil {
+			t.Errorf("ParseLogfmt(%q): got no error", bad)
+		}
+	}
+}
+
 var logRecordWriteTests = []struct {
 	Test    string
 	Record  *LogRecord
@@ -94,10 +394,10 @@ var logRecordWriteTests = []struct {
 }
 
 func TestConsoleLogWriter(t *testing.T) {
-	console := make(ConsoleLogWriter)
-
 	r, w := io.Pipe()
-	go console.run(w)
+	console := &ConsoleLogWriter{recordQueue: newRecordQueue(0), out: w}
+	console.SetFormat("[%T %D] [%L] %M")
+	go console.run()
 	defer console.Close()
 
 	buf := make([]byte, 1024)
@@ -115,6 +415,114 @@ func TestConsoleLogWriter(t *testing.T) {
 	}
 }
 
+func TestConsoleTargets(t *testing.T) {
+	defer func(out, errOut io.Writer) {
+		stdout, stderr = out, errOut
+	}(stdout, stderr)
+	var outBuf, errBuf bytes.Buffer
+	stdout, stderr = &outBuf, &errBuf
+
+	// Sync writers write before the log call returns
+	for _, test := range []struct {
+		opts     ConsoleOptions
+		out, err string
+	}{
+		{ConsoleOptions{Sync: true}, "[INFO] info\n[EROR] error\n", ""},
+		{ConsoleOptions{Target: ConsoleStderr, Sync: true}, "", "[INFO] info\n[EROR] error\n"},
+		{ConsoleOptions{Target: ConsoleSplit, Sync: true}, "[INFO] info\n", "[EROR] error\n"},
+		{ConsoleOptions{Target: ConsoleSplit, SplitLevel: INFO, SplitLevelSet: true, Sync: true}, "", "[INFO] info\n[EROR] error\n"},
+		{ConsoleOptions{Target: ConsoleSplit, SplitLevel: FINEST, SplitLevelSet: true, Sync: true}, "", "[INFO] info\n[EROR] error\n"},
+	} {
+		outBuf.Reset()
+		errBuf.Reset()
+		w := NewConsoleLogWriterWith(test.opts)
+		w.SetFormat("[%L] %M")
+		w.LogWrite(newLogRecord(INFO, "source", "info"))
+		w.LogWrite(newLogRecord(ERROR, "source", "error"))
+		if outBuf.String() != test.out || errBuf.String() != test.err {
+			t.Errorf("%+v: got %q and %q, want %q and %q", test.opts, outBuf.String(), errBuf.String(), test.out, test.err)
+		}
+		w.Close()
+	}
+
+	// Queued writers split the same way
+	outBuf.Reset()
+	errBuf.Reset()
+	w := NewConsoleLogWriterWith(ConsoleOptions{Target: ConsoleSplit})
+	w.SetFormat("[%L] %M")
+	w.LogWrite(newLogRecord(DEBUG, "source", "debug"))
+	w.LogWrite(newLogRecord(WARNING, "source", "warning"))
+	w.Close()
+	if outBuf.String() != "[DEBG] debug\n" || errBuf.String() != "[WARN] warning\n" {
+		t.Errorf("ConsoleSplit: got %q and %q", outBuf.String(), errBuf.String())
+	}
+
+	// The configuration may split from FINEST too
+	outBuf.Reset()
+	errBuf.Reset()
+	w, ok := xmlToConsoleLogWriter("test.xml", []xmlProperty{{"target", "split"}, {"splitlevel", "FINEST"}, {"sync", "true"}}, true)
+	if !ok {
+		t.Fatalf("xmlToConsoleLogWriter: splitlevel FINEST is invalid")
+	}
+	w.SetFormat("[%L] %M")
+	w.LogWrite(newLogRecord(FINEST, "source", "finest"))
+	w.Close()
+	if outBuf.String() != "" || errBuf.String() != "[FNST] finest\n" {
+		t.Errorf("splitlevel FINEST: got %q and %q", outBuf.String(), errBuf.String())
+	}
+	for _, value := range []string{"fasle", "no"} {
+		if _, ok := xmlToConsoleLogWriter("test.xml", []xmlProperty{{"sync", value}}, false); ok {
+			t.Errorf("xmlToConsoleLogWriter: sync %q should be invalid", value)
+		}
+	}
+}
+
+func TestConsoleColors(t *testing.T) {
+	console := &ConsoleLogWriter{recordQueue: newRecordQueue(0), out: new(bytes.Buffer)}
+	console.SetFormat("[%-5L] %M")
+	rec := newLogRecord(WARNING, "source", "message")
+
+	console.SetColors(Colors{Mode: ColorAlways, Verbs: "L"})
+	if got, want := string(console.format(rec, nil)), "[\x1b[33mWARN \x1b[0m] message\n"; got != want {
+		t.Errorf("SetColors: got %q, want %q", got, want)
+	}
+	palette, err := ParsePalette("WARNING=1;35, INFO=")
+	if err != nil {
+		t.Fatalf("ParsePalette: %s", err)
+	}
+	console.SetColors(Colors{Mode: ColorAlways, Palette: palette})
+	if got, want := string(console.format(rec, nil)), "\x1b[1;35m[WARN ] message\x1b[0m\n"; got != want {
+		t.Errorf("SetColors: got %q, want %q", got, want)
+	}
+	if got, want := string(console.format(newLogRecord(INFO, "source", "message"), nil)), "[INFO ] message\n"; got != want {
+		t.Errorf("SetColors: got %q for an uncolored level, want %q", got, want)
+	}
+	if palette[ERROR] != DefaultPalette[ERROR] {
+		t.Errorf("ParsePalette: got %q for ERROR, want the default %q", palette[ERROR], DefaultPalette[ERROR])
+	}
+
+	// Only terminals are colored automatically, and only PatternFormatters
+	console.SetColors(Colors{Mode: ColorAuto})
+	if got, want := string(console.format(rec, nil)), "[WARN ] message\n"; got != want {
+		t.Errorf("SetColors: got %q with ColorAuto, want %q", got, want)
+	}
+	console.SetColors(Colors{Mode: ColorAlways})
+	console.SetFormatter(LogfmtFormatter{})
+	if got := string(console.format(rec, nil)); strings.Contains(got, "\x1b") {
+		t.Errorf("SetColors: got %q from a LogfmtFormatter", got)
+	}
+	t.Setenv("NO_COLOR", "1")
+	if p := newPainter(Colors{Mode: ColorAuto}, os.Stdout); p != nil {
+		t.Errorf("newPainter: got %v with NO_COLOR set", p)
+	}
+
+	for _, bad := range []string{"INFO", "LOUD=31", "INFO=red"} {
+		if _, err := ParsePalette(bad); err == nil {
+			t.Errorf("ParsePalette(%q): got no error", bad)
+		}
+	}
+}
+
 func TestFileLogWriter(t *testing.T) {
 	defer func(buflen int) {
 		LogBufferLength = buflen
@@ -138,6 +546,196 @@ func TestFileLogWriter(t *testing.T) {
 	}
 }
 
+func TestFileLogWriterSetFormat(t *testing.T) {
+	w := NewFileLogWriter(testLogFile, false)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+
+	// The format may change while records are written
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			w.LogWrite(newLogRecord(INFO, "source", "message"))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		w.SetFormat("%M")
+	}
+	<-done
+	w.Close()
+
+	if contents, err := ioutil.ReadFile(testLogFile); err != nil {
+		t.Errorf("read(%q): %s", testLogFile, err)
+	} else if lines := strings.Count(string(contents), "\n"); lines != 100 {
+		t.Errorf("SetFormat: expected 100 lines, found %d", lines)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	// Buffered logging is written out by Flush
+	w := NewFileLogWriter(testLogFile, false).SetBlog(true)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	defer w.Close()
+
+	l := NewLogger().AddFilter("file", FINEST, w)
+	db := l.GetLogger("app.db")
+	for i := 0; i < 10; i++ {
+		db.Info("message %d", i)
+	}
+	if err := l.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if contents, err := ioutil.ReadFile(testLogFile); err != nil {
+		t.Errorf("read(%q): %s", testLogFile, err)
+	} else if n := strings.Count(string(contents), "\n"); n != 10 {
+		t.Errorf("Flush: expected 10 lines in %s, found %d", testLogFile, n)
+	}
+
+	// Flush gives up when the context is done
+	block := make(chan bool)
+	fw := NewFormatLogWriter(blockingWriter(block), "%M")
+	defer fw.Close()
+	defer close(block)
+	fw.LogWrite(newLogRecord(INFO, "source", "stuck"))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := NewLogger().AddFilter("stuck", INFO, fw).Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Flush: got %v from a stuck writer, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestCloseContext(t *testing.T) {
+	// Close returns once the records are in the file
+	w := NewFileLogWriter(testLogFile, false)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	for i := 0; i < 100; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("message %d", i)))
+	}
+	w.Close()
+	if contents, err := ioutil.ReadFile(testLogFile); err != nil {
+		t.Errorf("read(%q): %s", testLogFile, err)
+	} else if n := strings.Count(string(contents), "\n"); n != 100 {
+		t.Errorf("Close: expected 100 lines in %s, found %d", testLogFile, n)
+	}
+	if err := w.CloseContext(context.Background()); err != nil {
+		t.Errorf("CloseContext: got %v closing again", err)
+	}
+
+	// CloseContext gives up when the context is done, and can be called again
+	block := make(chan bool)
+	fw := NewFormatLogWriter(blockingWriter(block), "%M")
+	fw.LogWrite(newLogRecord(INFO, "source", "stuck"))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := fw.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("CloseContext: got %v from a stuck writer, want %v", err, context.DeadlineExceeded)
+	}
+	close(block)
+	if err := fw.CloseContext(context.Background()); err != nil {
+		t.Errorf("CloseContext: got %v once unstuck", err)
+	}
+
+	// The logger reports the errors of all its writers
+	err1, err2 := errors.New("first"), errors.New("second")
+	l := NewLogger()
+	l.AddFilter("ok", INFO, new(recordingWriter))
+	l.AddFilter("bad1", INFO, &failingCloser{err: err1})
+	l.AddFilter("bad2", INFO, NewDedupLogWriter(&failingCloser{err: err2}, time.Second))
+	err := l.CloseContext(context.Background())
+	if !errors.Is(err, err1) || !errors.Is(err, err2) {
+		t.Errorf("Logger.CloseContext: got %v, want both %v and %v", err, err1, err2)
+	}
+}
+
+// failingCloser is a LogWriter which fails to close
+type failingCloser struct {
+	recordingWriter
+	err error
+}
+
+func (w *failingCloser) CloseContext(ctx context.Context) error {
+	w.Close()
+	return w.err
+}
+
+func TestErrorHandler(t *testing.T) {
+	errBroken := errors.New("broken")
+	errs := make(chan *WriterError, 10)
+	handler := func(err *WriterError) {
+		errs <- err
+	}
+
+	// A writer carries on after reporting a failure to its own handler
+	w := NewFormatLogWriter(failingWriter{errBroken}, "%M")
+	w.SetErrorHandler(handler)
+	w.LogWrite(newLogRecord(INFO, "source", "one"))
+	w.LogWrite(newLogRecord(INFO, "source", "two"))
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err.Tag != "" || err.Op != "write" || !errors.Is(err, errBroken) {
+			t.Errorf("FormatLogWriter: got %+v, want a write error", err)
+		}
+	}
+	w.Close()
+
+	// The handler of a logger gets the failures of writers added before and
+	// after it is set, tagged with the names of their filters
+	l := NewLogger()
+	defer l.Close()
+	l.AddFilter("before", INFO, NewFormatLogWriter(failingWriter{errBroken}, "%M"))
+	l.SetErrorHandler(handler)
+	l.GetLogger("app").AddFilter("after", INFO, NewDedupLogWriter(NewFormatLogWriter(failingWriter{errBroken}, "%M"), 0))
+	l.GetLogger("app").Info("message")
+	tags := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		tags[err.Tag] = true
+		if want := fmt.Sprintf("log4go: filter %q: FormatLogWriter: write: broken", err.Tag); err.Error() != want {
+			t.Errorf("Logger.SetErrorHandler: got %q, want %q", err, want)
+		}
+	}
+	if !tags["before"] || !tags["after"] {
+		t.Errorf("Logger.SetErrorHandler: got errors tagged %v, want before and after", tags)
+	}
+
+	// Writers which fail to start report it to DefaultErrorHandler
+	defer func(h ErrorHandler) {
+		DefaultErrorHandler = h
+	}(DefaultErrorHandler)
+	DefaultErrorHandler = handler
+	if fw := NewFileLogWriter("_nonexistent/_logtest.log", false); fw != nil {
+		t.Fatalf("NewFileLogWriter: expected nil for a missing directory")
+	}
+	if err := <-errs; err.Op != "open" || !os.IsNotExist(errors.Unwrap(err)) {
+		t.Errorf("NewFileLogWriter: got %v, want an open error", err)
+	}
+}
+
+// failingWriter is an io.Writer which always fails
+type failingWriter struct {
+	err error
+}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+// blockingWriter is an io.Writer which waits for its channel to close
+type blockingWriter chan bool
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w
+	return len(p), nil
+}
+
 func TestXMLLogWriter(t *testing.T) {
 	defer func(buflen int) {
 		LogBufferLength = buflen
@@ -166,26 +764,26 @@ func TestLogger(t *testing.T) {
 	if sl == nil {
 		t.Fatalf("NewDefaultLogger should never return nil")
 	}
-	if lw, exist := sl["stdout"]; lw == nil || exist != true {
+	if lw, exist := sl.Filters()["stdout"]; lw == nil || exist != true {
 		t.Fatalf("NewDefaultLogger produced invalid logger (DNE or nil)")
 	}
-	if sl["stdout"].Level != WARNING {
+	if sl.Filters()["stdout"].Level() != WARNING {
 		t.Fatalf("NewDefaultLogger produced invalid logger (incorrect level)")
 	}
-	if len(sl) != 1 {
+	if len(sl.Filters()) != 1 {
 		t.Fatalf("NewDefaultLogger produced invalid logger (incorrect map count)")
 	}
 
 	//func (l *Logger) AddFilter(name string, level int, writer LogWriter) {}
-	l := make(Logger)
+	l := NewLogger()
 	l.AddFilter("stdout", DEBUG, NewConsoleLogWriter())
-	if lw, exist := l["stdout"]; lw == nil || exist != true {
+	if lw, exist := l.Filters()["stdout"]; lw == nil || exist != true {
 		t.Fatalf("AddFilter produced invalid logger (DNE or nil)")
 	}
-	if l["stdout"].Level != DEBUG {
+	if l.Filters()["stdout"].Level() != DEBUG {
 		t.Fatalf("AddFilter produced invalid logger (incorrect level)")
 	}
-	if len(l) != 1 {
+	if len(l.Filters()) != 1 {
 		t.Fatalf("AddFilter produced invalid logger (incorrect map count)")
 	}
 
@@ -215,6 +813,900 @@ func TestLogger(t *testing.T) {
 	//func (l *Logger) Info(format string, args ...interface{}) {}
 }
 
+// recordingWriter is a LogWriter which keeps every record written to it.
+type recordingWriter struct {
+	mu     sync.Mutex
+	recs   []*LogRecord
+	closed bool
+}
+
+func (w *recordingWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.recs = append(w.recs, rec)
+}
+
+func (w *recordingWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+}
+
+func (w *recordingWriter) records() []*LogRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*LogRecord(nil), w.recs...)
+}
+
+// stallingWriter blocks writing the message "stall" until release is closed
+type stallingWriter struct {
+	recordingWriter
+	stalled, release chan struct{}
+	closedEarly      bool
+}
+
+func (w *stallingWriter) LogWrite(rec *LogRecord) {
+	if rec.Message == "stall" {
+		close(w.stalled)
+		<-w.release
+	}
+	w.recordingWriter.LogWrite(rec)
+}
+
+func (w *stallingWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closedEarly = len(w.recs) == 0
+	w.closed = true
+}
+
+func TestStalledWriter(t *testing.T) {
+	slow := &stallingWriter{stalled: make(chan struct{}), release: make(chan struct{})}
+	other := new(recordingWriter)
+	l := NewLogger().AddFilter("slow", FINEST, slow).AddFilter("other", WARNING, other)
+
+	go l.Info("stall")
+	<-slow.stalled
+
+	// A stalled writer holds up neither changes to the filters it is not
+	// writing to nor other log calls
+	done := make(chan struct{})
+	go func() {
+		l.RemoveFilter("other")
+		l.GetLogger("app").AddFilter("app", FINEST, new(recordingWriter))
+		l.GetLogger("app").Info("not stalled")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("RemoveFilter: held up by a stalled writer")
+	}
+
+	// Closing it waits for the write
+	closed := make(chan struct{})
+	go func() {
+		l.RemoveFilter("slow")
+		close(closed)
+	}()
+	close(slow.release)
+	<-closed
+	if slow.mu.Lock(); slow.closedEarly || !slow.closed {
+		t.Errorf("RemoveFilter: closed before the write (%v) or not at all (%v)", slow.closedEarly, !slow.closed)
+	}
+	slow.mu.Unlock()
+}
+
+func TestRemoveReplaceFilter(t *testing.T) {
+	w1, w2 := new(recordingWriter), new(recordingWriter)
+	l := NewLogger().AddFilter("a", FINEST, w1)
+
+	l.Info("one")
+	if replaced := l.ReplaceFilter("a", WARNING, w2); !replaced {
+		t.Errorf("ReplaceFilter: expected to replace filter %q", "a")
+	}
+	l.Info("two")
+	l.Warn("three")
+
+	if n := len(w1.records()); n != 1 {
+		t.Errorf("ReplaceFilter: old writer got %d records, want 1", n)
+	}
+	if n := len(w2.records()); n != 1 {
+		t.Errorf("ReplaceFilter: new writer got %d records, want 1", n)
+	}
+	if filt := l.Filters()["a"]; filt == nil || filt.LogWriter != w2 || filt.Level() != WARNING {
+		t.Errorf("ReplaceFilter: Filters() reports %+v", filt)
+	}
+
+	if !l.RemoveFilter("a") {
+		t.Errorf("RemoveFilter: expected to remove filter %q", "a")
+	}
+	if l.RemoveFilter("a") {
+		t.Errorf("RemoveFilter: filter %q removed twice", "a")
+	}
+	l.Critical("four")
+	if n := len(w2.records()); n != 1 || len(l.Filters()) != 0 {
+		t.Errorf("RemoveFilter: writer got %d records after removal, %d filters left", n, len(l.Filters()))
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	w := new(recordingWriter)
+	l := NewLogger().AddFilter("rec", WARNING, w)
+
+	if l.enabled(INFO) || !l.enabled(WARNING) {
+		t.Errorf("enabled: wrong answer for filter at %s", WARNING)
+	}
+	l.Info("dropped")
+	if !l.SetLevel("rec", DEBUG) {
+		t.Errorf("SetLevel: expected filter %q to exist", "rec")
+	}
+	if l.SetLevel("missing", DEBUG) {
+		t.Errorf("SetLevel: filter %q should not exist", "missing")
+	}
+	l.Info("written")
+	l.Filters()["rec"].SetLevel(ERROR)
+	l.Warn("dropped")
+	if l.enabled(WARNING) || !l.enabled(ERROR) {
+		t.Errorf("enabled: Filter.SetLevel did not update the cached level")
+	}
+
+	l.SetLevel("rec", FINEST)
+	l.SetThreshold(INFO)
+	if got := l.Threshold(); got != INFO {
+		t.Errorf("Threshold: got %s, want %s", got, INFO)
+	}
+	l.Debug("dropped")
+	l.Info("written")
+	l.SetThreshold(FINEST)
+	l.Debug("written")
+
+	var msgs []string
+	for _, rec := range w.records() {
+		msgs = append(msgs, rec.Message)
+	}
+	if got, want := strings.Join(msgs, ","), "written,written,written"; got != want {
+		t.Errorf("SetLevel: got messages %q, want %q", got, want)
+	}
+
+	// Levels may change while other goroutines are logging
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			l.Debug("concurrent")
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		l.SetLevel("rec", Level(i%int(CRITICAL)))
+		l.SetThreshold(Level(i % int(INFO)))
+	}
+	<-done
+}
+
+func TestGetLogger(t *testing.T) {
+	rootw, appw, dbw := new(recordingWriter), new(recordingWriter), new(recordingWriter)
+	root := NewLogger().AddFilter("root", FINEST, rootw)
+	root.SetThreshold(INFO)
+
+	app := root.GetLogger("app")
+	app.AddFilter("app", FINEST, appw)
+	pool := root.GetLogger("app.db.pool")
+	db := pool.GetLogger("app.db")
+	db.AddFilter("db", FINEST, dbw)
+
+	if got := pool.Name(); got != "app.db.pool" {
+		t.Errorf("Name: got %q, want %q", got, "app.db.pool")
+	}
+	if got := root.GetLogger("app.db").cat.parent; got != app.cat {
+		t.Errorf("GetLogger: app.db should be a child of app")
+	}
+	for _, name := range []string{"app..db", ".app.db", "app.db.", "..app...db.."} {
+		if got := root.GetLogger(name); got.cat != db.cat {
+			t.Errorf("GetLogger(%q): got %q, want app.db", name, got.Name())
+		}
+	}
+	if got := root.GetLogger("..."); got.cat != root.cat {
+		t.Errorf("GetLogger(%q): got %q, want the root logger", "...", got.Name())
+	}
+
+	// Levels are inherited from the nearest ancestor with a threshold
+	pool.Debug("dropped by root threshold")
+	app.SetThreshold(DEBUG)
+	if got := pool.Threshold(); got != DEBUG {
+		t.Errorf("Threshold: pool inherits %s, want %s", got, DEBUG)
+	}
+	pool.Debug("pool debug")
+	pool.SetThreshold(ERROR)
+	pool.Warn("dropped by pool threshold")
+	pool.ClearThreshold()
+	root.Debug("dropped by root threshold")
+
+	// Additivity stops records at app.db
+	db.SetAdditivity(false)
+	pool.Info("pool info")
+	db.SetAdditivity(true)
+
+	count := func(w *recordingWriter) (n int, cats []string) {
+		for _, rec := range w.records() {
+			cats = append(cats, strings.TrimSuffix(FormatLogRecord("%c:%M", rec), "\n"))
+		}
+		return len(cats), cats
+	}
+	if n, cats := count(rootw); n != 1 || cats[0] != "app.db.pool:pool debug" {
+		t.Errorf("root filter got %q", cats)
+	}
+	if n, cats := count(appw); n != 1 {
+		t.Errorf("app filter got %q", cats)
+	}
+	if n, cats := count(dbw); n != 2 || cats[1] != "app.db.pool:pool info" {
+		t.Errorf("db filter got %q", cats)
+	}
+
+	// Closing a named logger only closes its own filters
+	db.Close()
+	if len(db.Filters()) != 0 || len(app.Filters()) != 1 {
+		t.Errorf("Close: named logger closed %d/%d filters", len(db.Filters()), len(app.Filters()))
+	}
+	root.Close()
+	if len(app.Filters()) != 0 || len(root.Filters()) != 0 {
+		t.Errorf("Close: root logger should close the whole hierarchy")
+	}
+}
+
+func TestVModule(t *testing.T) {
+	w := new(recordingWriter)
+	l := NewLogger().AddFilter("rec", WARNING, w)
+
+	for _, spec := range []string{"nolevel", "=DEBUG", "pkg=LOUD", "[=DEBUG"} {
+		if err := l.SetVModule(spec); err == nil {
+			t.Errorf("SetVModule(%q) should fail", spec)
+		}
+	}
+
+	// Matches this file by its base name
+	const spec = "nomatch/*=CRITICAL,log4go_test=FINE"
+	if err := l.SetVModule(spec); err != nil {
+		t.Fatalf("SetVModule(%q): %s", spec, err)
+	}
+	if got := l.VModule(); got != spec {
+		t.Errorf("VModule: got %q, want %q", got, spec)
+	}
+	l.Finest("dropped by rule")
+	l.Fine("written by rule")
+	l.Log(FINE, "manual", "dropped by filter")
+
+	// Rules can also raise the level
+	l.SetVModule("*_test=ERROR")
+	l.Warn("dropped by rule")
+	l.Error("written by rule")
+	l.Log(WARNING, "manual", "written by filter")
+
+	l.SetVModule("")
+	l.Fine("dropped by filter")
+
+	var msgs []string
+	for _, rec := range w.records() {
+		msgs = append(msgs, rec.Message)
+	}
+	if got, want := strings.Join(msgs, ","), "written by rule,written by rule,written by filter"; got != want {
+		t.Errorf("SetVModule: got messages %q, want %q", got, want)
+	}
+
+	// Loading a configuration without rules removes those of the last one
+	config := filepath.Join(t.TempDir(), "vmodule.xml")
+	for _, want := range []string{"log4go_test=FINE", ""} {
+		doc := "<logging><vmodule>" + want + "</vmodule></logging>"
+		if len(want) == 0 {
+			doc = "<logging></logging>"
+		}
+		if err := os.WriteFile(config, []byte(doc), 0644); err != nil {
+			t.Fatal(err)
+		}
+		l.LoadConfiguration(config)
+		if got := l.VModule(); got != want {
+			t.Errorf("LoadConfiguration(%q): got rules %q, want %q", doc, got, want)
+		}
+	}
+}
+
+func TestVModuleEnv(t *testing.T) {
+	// Parse the environment again, as restored by Setenv, after the test
+	defer func() {
+		envVModuleOnce, envVModule, envVModuleErr = sync.Once{}, nil, nil
+	}()
+
+	t.Setenv(VModuleEnv, "log4go_test=FINE,pkg=LOUD")
+	envVModuleOnce, envVModule, envVModuleErr = sync.Once{}, nil, nil
+	if vm := vmoduleFromEnv(); vm != nil {
+		t.Errorf("%s: invalid rules should be ignored, found %q", VModuleEnv, vm)
+	}
+	if err := VModuleEnvError(); err == nil || !strings.Contains(err.Error(), VModuleEnv) {
+		t.Errorf("VModuleEnvError: got %v, want an error naming %s", err, VModuleEnv)
+	}
+
+	// It is passed to the first handler set on a hierarchy
+	var reported []*WriterError
+	l := NewLogger()
+	for i := 0; i < 2; i++ {
+		l.SetErrorHandler(func(err *WriterError) {
+			reported = append(reported, err)
+		})
+	}
+	if len(reported) != 1 || reported[0].Writer != VModuleEnv || reported[0].Op != "parse" {
+		t.Errorf("SetErrorHandler: got %v, want the error in %s once", reported, VModuleEnv)
+	}
+
+	t.Setenv(VModuleEnv, "log4go_test=FINE")
+	envVModuleOnce, envVModule, envVModuleErr = sync.Once{}, nil, nil
+	if err := VModuleEnvError(); err != nil {
+		t.Errorf("VModuleEnvError: %s", err)
+	}
+	if vm := vmoduleFromEnv(); vm == nil || vm.String() != "log4go_test=FINE" {
+		t.Errorf("%s: got rules %v", VModuleEnv, vm)
+	}
+}
+
+// facade wraps a logger the way an application's logging package might
+type facade struct {
+	log *Logger
+}
+
+func (f facade) Info(msg string) {
+	f.log.Info(msg)
+}
+
+func TestCallerSkip(t *testing.T) {
+	w := new(recordingWriter)
+	l := NewLogger().AddFilter("rec", FINEST, w)
+
+	_, file, line, _ := runtime.Caller(0)
+	facade{l}.Info("facade")                   // line+1
+	facade{l.WithCallerSkip(1)}.Info("caller") // line+2
+	l.WithCallerSkip(1).With(Int("n", 1)).WithCallerSkip(-1).Info("direct")
+
+	recs := w.records()
+	if len(recs) != 3 {
+		t.Fatalf("WithCallerSkip: expected 3 records, found %d", len(recs))
+	}
+	if fn := recs[0].Func; !strings.HasSuffix(fn, ".facade.Info") {
+		t.Errorf("WithCallerSkip: facade record has function %q", fn)
+	}
+	for i, want := range []int{line + 2, line + 3} {
+		rec := recs[i+1]
+		if !strings.HasSuffix(rec.Func, ".TestCallerSkip") || rec.File != file || rec.Line != want {
+			t.Errorf("WithCallerSkip: record %q has source %s %s:%d, want TestCallerSkip %s:%d", rec.Message, rec.Func, rec.File, rec.Line, file, want)
+		}
+	}
+
+	pkg := funcPackage(recs[1].Func)
+	for format, want := range map[string]string{
+		"%f": fmt.Sprintf("log4go_test.go:%d\n", line+2),
+		"%F": fmt.Sprintf("%s:%d\n", file, line+2),
+		"%s": fmt.Sprintf("%s.TestCallerSkip:%d\n", pkg[strings.LastIndex(pkg, "/")+1:], line+2),
+		"%P": pkg + "\n",
+	} {
+		if got := FormatLogRecord(format, recs[1]); got != want {
+			t.Errorf("FormatLogRecord(%q): got %q, want %q", format, got, want)
+		}
+	}
+}
+
+func TestStackTrace(t *testing.T) {
+	w := new(recordingWriter)
+	l := NewLogger().AddFilter("rec", FINEST, w)
+	l.SetStackTrace(&StackTrace{Level: ERROR, Depth: 4})
+	db := l.GetLogger("app.db")
+
+	l.Warn("no stack")
+	facade{l.WithCallerSkip(1)}.Info("below")
+	l.Error("stack")
+	db.Critical("inherited")
+	db.SetStackTrace(&StackTrace{Level: CRITICAL, AllGoroutines: true})
+	db.Critical("all")
+	db.SetStackTrace(&StackTrace{Level: CRITICAL + 1})
+	db.Critical("disabled")
+	l.SetStackTrace(nil)
+	l.Error("root disabled")
+
+	recs := w.records()
+	if len(recs) != 7 {
+		t.Fatalf("SetStackTrace: expected 7 records, found %d", len(recs))
+	}
+	for _, i := range []int{0, 1, 5, 6} {
+		if len(recs[i].Stack) > 0 {
+			t.Errorf("SetStackTrace: record %q has stack %q", recs[i].Message, recs[i].Stack)
+		}
+	}
+	for _, i := range []int{2, 3} {
+		stack := recs[i].Stack
+		if !strings.HasPrefix(stack, recs[i].Func+"\n\t") || !strings.HasSuffix(recs[i].Func, ".TestStackTrace") {
+			t.Errorf("SetStackTrace: record %q has stack %q", recs[i].Message, stack)
+		}
+		if frames := strings.Count(stack, "\n\t"); frames < 1 || frames > 4 {
+			t.Errorf("SetStackTrace: record %q has %d frames, want 1 to 4", recs[i].Message, frames)
+		}
+		if strings.Contains(stack, "runtime.") || strings.Contains(stack, "log4go.go") {
+			t.Errorf("SetStackTrace: record %q has unfiltered frames:\n%s", recs[i].Message, stack)
+		}
+	}
+	if stack := recs[4].Stack; !strings.HasPrefix(stack, "goroutine ") || !strings.Contains(stack, "TestStackTrace") {
+		t.Errorf("SetStackTrace: AllGoroutines record has stack %q", stack)
+	}
+
+	if got, want := FormatLogRecord("%M%K", recs[2]), "stack\n"+recs[2].Stack; got != want {
+		t.Errorf("FormatLogRecord(%%K): got %q, want %q", got, want)
+	}
+	if got := string(XMLFormatter{}.Format(recs[2], nil)); !strings.Contains(got, "<stack>"+recs[2].Func) {
+		t.Errorf("XMLFormatter: missing stack in %q", got)
+	}
+	if data, err := json.Marshal(recs[2]); err != nil || !strings.Contains(string(data), `"Stack":`) {
+		t.Errorf("json.Marshal: missing stack in %s (%v)", data, err)
+	}
+}
+
+func TestLoggerConcurrentReconfigure(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+
+	l := NewLogger()
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					l.Info("concurrent message")
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		l.AddFilter("out", INFO, NewFormatLogWriter(ioutil.Discard, FORMAT_ABBREV))
+		l.ReplaceFilter("out", DEBUG, NewFormatLogWriter(ioutil.Discard, FORMAT_ABBREV))
+		l.RemoveFilter("out")
+	}
+	close(stop)
+	wg.Wait()
+	l.Close()
+}
+
+func TestLoggerWith(t *testing.T) {
+	w := new(recordingWriter)
+	l := NewLogger().AddFilter("rec", FINEST, w)
+
+	req := l.With(String("request", "abc"))
+	req.With(Int("attempt", 2)).Info("first")
+	req.Warn("second")
+	l.Info("third")
+
+	recs := w.records()
+	if len(recs) != 3 {
+		t.Fatalf("With: expected 3 records, found %d", len(recs))
+	}
+	for i, want := range []string{"request=abc attempt=2", "request=abc", ""} {
+		if got := strings.TrimSuffix(FormatLogRecord("%X", recs[i]), "\n"); got != want {
+			t.Errorf("With: record %d has fields %q, want %q", i, got, want)
+		}
+	}
+
+	// Filters added to the parent are shared with its children
+	w2 := new(recordingWriter)
+	l.AddFilter("rec2", FINEST, w2)
+	req.Info("fourth")
+	if n := len(w2.records()); n != 1 {
+		t.Errorf("With: child should write to filters added to parent, found %d records", n)
+	}
+}
+
+func TestFieldsJSON(t *testing.T) {
+	rec := newLogRecord(INFO, "source", "message")
+	rec.Fields = Fields{
+		String("user", "kyle"),
+		Int("shard", 3),
+		Float64("load", 0.5),
+		Duration("elapsed", 1500*time.Millisecond),
+		Any("tags", []string{"a", "b"}),
+	}
+	js, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatalf("json.Marshal: %s", err)
+	}
+	const want = `"Fields":{"user":"kyle","shard":3,"load":0.5,"elapsed":"1.5s","tags":["a","b"]}`
+	if !strings.Contains(string(js), want) {
+		t.Errorf("json.Marshal: got %s, want it to contain %s", js, want)
+	}
+
+	// Fields built by hand have no value, which does not stop them from
+	// being written
+	rec.Fields = Fields{{Key: "t", Type: TimeType}, {Key: "e", Type: ErrorType}}
+	if js, err := rec.Fields.MarshalJSON(); err != nil || string(js) != `{"t":"<nil>","e":null}` {
+		t.Errorf("MarshalJSON: got %s (%v) for fields built by hand", js, err)
+	}
+	if got := FormatLogRecord("%X", rec); got != "t=<nil> e=<nil>\n" {
+		t.Errorf("FormatLogRecord(%%X): got %q for fields built by hand", got)
+	}
+	if v, ok := rec.Fields.Get("e"); !ok || v != nil {
+		t.Errorf("Get: got %v for an error field built by hand", v)
+	}
+	for _, f := range []Formatter{JSONFormatter{}, LogfmtFormatter{}, XMLFormatter{}} {
+		f.Format(rec, nil)
+	}
+
+	rec.Fields = nil
+	if js, _ := json.Marshal(rec); strings.Contains(string(js), "Fields") {
+		t.Errorf("json.Marshal: empty fields should be omitted: %s", js)
+	}
+}
+
+func TestErrorChain(t *testing.T) {
+	w := new(recordingWriter)
+	l := NewLogger().AddFilter("rec", FINEST, w)
+
+	cause := errors.New("disk full")
+	wrapped := fmt.Errorf("saving: %w", cause)
+	if err := l.Error("request failed: %w", wrapped); !errors.Is(err, cause) || err.Error() != "request failed: saving: disk full" {
+		t.Errorf("Error: returned %q, which should wrap %q", err, cause)
+	}
+	if err := l.Warn(wrapped, 3); !errors.Is(err, cause) || err.Error() != "saving: disk full 3" {
+		t.Errorf("Warn: returned %q, which should wrap %q", err, cause)
+	}
+	if err := l.CriticalCtx(context.Background(), "%w", cause); !errors.Is(err, cause) {
+		t.Errorf("CriticalCtx: returned %q, which should wrap %q", err, cause)
+	}
+
+	// A message without arguments is not a format
+	literal := new(recordingWriter)
+	ll := NewLogger().AddFilter("rec", FINEST, literal)
+	if err := ll.Warn("disk 90% full"); err.Error() != "disk 90% full" || literal.records()[0].Message != "disk 90% full" {
+		t.Errorf("Warn: returned %q and logged %q, want the literal message", err, literal.records()[0].Message)
+	}
+	if err := ll.Error(struct{ Pct string }{"90%"}); err.Error() != "{90%}" {
+		t.Errorf("Error: returned %q, want %q", err, "{90%}")
+	}
+	l.With(Err(wrapped)).Info("with chain")
+
+	recs := w.records()
+	if len(recs) != 4 {
+		t.Fatalf("Err: expected 4 records, found %d", len(recs))
+	}
+	if got, want := recs[0].Message, "request failed: saving: disk full"; got != want {
+		t.Errorf("Error: logged %q, want %q", got, want)
+	}
+	f := recs[3].Fields[0]
+	if v, _ := recs[3].Fields.Get("error"); v != wrapped {
+		t.Errorf("Err: value is %v, want %v", v, wrapped)
+	}
+	chain := f.ErrorChain()
+	if len(chain) != 2 || chain[0].Message != "saving: disk full" || chain[1] != (ErrorInfo{"*errors.errorString", "disk full"}) {
+		t.Errorf("Err: chain is %+v", chain)
+	}
+	if got, want := FormatLogRecord("%X", recs[3]), "error=saving: disk full\n"; got != want {
+		t.Errorf("FormatLogRecord(%%X): got %q, want %q", got, want)
+	}
+
+	js, err := json.Marshal(Fields{f, Err(nil)})
+	if err != nil {
+		t.Fatalf("json.Marshal: %s", err)
+	}
+	want := `{"error":{"message":"saving: disk full","chain":[{"type":"` + chain[0].Type + `","message":"saving: disk full"},{"type":"*errors.errorString","message":"disk full"}]},"error":null}`
+	if string(js) != want {
+		t.Errorf("json.Marshal: got %s, want %s", js, want)
+	}
+	if got := string(XMLFormatter{}.Format(recs[3], nil)); !strings.Contains(got, `<field key="error"><error type="`+chain[0].Type+`">saving: disk full</error><error type="*errors.errorString">disk full</error></field>`) {
+		t.Errorf("XMLFormatter: error chain missing from %q", got)
+	}
+}
+
+func TestFilterLimits(t *testing.T) {
+	w := new(recordingWriter)
+	filt := &Filter{level: int32(FINEST), LogWriter: w}
+	filt.SetLimits(&Limits{SampleInterval: time.Second, SampleFirst: 2, SampleThereafter: 3, ReportInterval: time.Second})
+
+	now := time.Now()
+	write := func(lvl Level, src string, at time.Duration) {
+		filt.LogWrite(&LogRecord{Level: lvl, Source: src, Message: src, Created: now.Add(at)})
+	}
+	for i := 0; i < 8; i++ {
+		write(DEBUG, "loop", 0)
+	}
+	write(INFO, "loop", 0)
+	write(DEBUG, "other", 0)
+	write(DEBUG, "loop", 1500*time.Millisecond)
+
+	var got []string
+	for _, rec := range w.records() {
+		got = append(got, rec.Message)
+	}
+	want := "loop,loop,loop,loop,loop,other,suppressed 4 records in 1.5s (4 by sampling, 0 by rate limit),loop"
+	if strings.Join(got, ",") != want {
+		t.Errorf("Sampling: got %q, want %q", strings.Join(got, ","), want)
+	}
+	if rec := w.records()[6]; rec.Level != DEBUG {
+		t.Errorf("Sampling: summary has level %s, want %s", rec.Level, DEBUG)
+	}
+
+	w2 := new(recordingWriter)
+	filt = &Filter{level: int32(FINEST), LogWriter: w2}
+	filt.SetLimits(&Limits{Rate: 10, Burst: 2})
+	for i := 0; i < 5; i++ {
+		write(WARNING, "burst", 0)
+	}
+	write(ERROR, "burst", 50*time.Millisecond)
+	write(INFO, "burst", 150*time.Millisecond)
+	write(INFO, "burst", 300*time.Millisecond)
+	filt.Close()
+
+	recs := w2.records()
+	if len(recs) != 5 {
+		t.Fatalf("RateLimit: expected 5 records, found %d", len(recs))
+	}
+	if sum := recs[4]; sum.Level != ERROR || !strings.HasPrefix(sum.Message, "suppressed 4 records") || sum.Fields[1].Value() != int64(4) {
+		t.Errorf("RateLimit: final summary is %s %q %v", sum.Level, sum.Message, sum.Fields)
+	}
+	if w2.mu.Lock(); !w2.closed {
+		t.Errorf("RateLimit: Close did not close the writer")
+	}
+	w2.mu.Unlock()
+
+	// With no record written after them, suppressed records are reported
+	// by the timer
+	w3 := new(recordingWriter)
+	filt = &Filter{level: int32(FINEST), LogWriter: w3}
+	filt.SetLimits(&Limits{Rate: 1, ReportInterval: 50 * time.Millisecond})
+	for i := 0; i < 3; i++ {
+		filt.LogWrite(&LogRecord{Level: INFO, Source: "timer", Message: "timer", Created: time.Now()})
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(w3.records()) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	recs = w3.records()
+	filt.Close()
+	if len(recs) != 2 || !strings.HasPrefix(recs[1].Message, "suppressed 2 records") {
+		var got []string
+		for _, rec := range recs {
+			got = append(got, rec.Message)
+		}
+		t.Errorf("ReportInterval: got %q, want the record and a summary of 2", got)
+	}
+}
+
+func TestDedupLogWriter(t *testing.T) {
+	w := new(recordingWriter)
+	d := NewDedupLogWriter(w, time.Hour)
+
+	now := time.Now()
+	write := func(lvl Level, msg string) {
+		d.LogWrite(&LogRecord{Level: lvl, Source: "retry", Message: msg, Created: now})
+	}
+	write(WARNING, "connection refused")
+	write(WARNING, "connection refused")
+	write(WARNING, "connection refused")
+	write(ERROR, "connection refused")
+	write(ERROR, "giving up")
+	write(ERROR, "giving up")
+	d.Close()
+
+	var got []string
+	for _, rec := range w.records() {
+		got = append(got, rec.Level.String()+" "+rec.Message)
+	}
+	want := "WARN connection refused,WARN last message repeated 2 times,EROR connection refused,EROR giving up,EROR last message repeated 1 times"
+	if strings.Join(got, ",") != want {
+		t.Errorf("Dedup: got %q, want %q", strings.Join(got, ","), want)
+	}
+	if !w.closed {
+		t.Errorf("Dedup: Close did not close the writer")
+	}
+
+	// The count is written when the window expires
+	w = new(recordingWriter)
+	d = NewDedupLogWriter(w, 20*time.Millisecond)
+	defer d.Close()
+	now = time.Now()
+	write(INFO, "tick")
+	write(INFO, "tick")
+	time.Sleep(100 * time.Millisecond)
+	if recs := w.records(); len(recs) != 2 || recs[1].Message != "last message repeated 1 times" {
+		t.Errorf("Dedup: expected the repeat count after the window, found %d records", len(recs))
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]Level{
+		"FINEST": FINEST, "fnst": FINEST, "Debug": DEBUG, "TRAC": TRACE,
+		"warning": WARNING, "WARN": WARNING, " EROR ": ERROR, "critical": CRITICAL, "3": TRACE,
+	} {
+		if lvl, err := ParseLevel(name); err != nil || lvl != want {
+			t.Errorf("ParseLevel(%q): got %v (%v), want %v", name, lvl, err, want)
+		}
+	}
+	if _, err := ParseLevel("LOUD"); err == nil {
+		t.Errorf("ParseLevel(%q): expected an error", "LOUD")
+	}
+
+	if got := WARNING.Name(); got != "WARNING" {
+		t.Errorf("Name: got %q, want %q", got, "WARNING")
+	}
+	if got := Level(8).String(); got != "UNKNOWN" {
+		t.Errorf("String: got %q for an unknown level", got)
+	}
+
+	rec := &LogRecord{Level: ERROR, Message: "oops"}
+	js, err := json.Marshal(rec)
+	if err != nil || !strings.Contains(string(js), `"Level":"ERROR"`) {
+		t.Errorf("json.Marshal: got %s (%v)", js, err)
+	}
+	var decoded LogRecord
+	if err := json.Unmarshal(js, &decoded); err != nil || decoded.Level != ERROR {
+		t.Errorf("json.Unmarshal: got %v (%v), want %v", decoded.Level, err, ERROR)
+	}
+	if err := json.Unmarshal([]byte(`{"Level":5}`), &decoded); err != nil || decoded.Level != WARNING {
+		t.Errorf("json.Unmarshal: got %v (%v) for a numeric level, want %v", decoded.Level, err, WARNING)
+	}
+
+	const AUDIT = Level(100)
+	if err := RegisterLevel(AUDIT, "AUDIT", "AUDT"); err != nil {
+		t.Fatalf("RegisterLevel: %s", err)
+	}
+	t.Cleanup(func() { unregisterLevel(AUDIT) })
+	if err := RegisterLevel(Level(101), "audit", "AUD2"); err == nil {
+		t.Errorf("RegisterLevel: expected an error for a name in use")
+	}
+	if err := RegisterLevel(INFO, "NOTICE", "NOTC"); err == nil {
+		t.Errorf("RegisterLevel: expected an error for a built-in level")
+	}
+	for _, name := range []string{`AU"DIT`, "AU<DIT", "AU&DIT", "AU DIT", "AU=DIT", "AUDÏT"} {
+		if err := RegisterLevel(Level(102), name, "AUD3"); err == nil {
+			t.Errorf("RegisterLevel(%q): expected an error for an invalid name", name)
+		}
+	}
+	if lvl, err := ParseLevel("audt"); err != nil || lvl != AUDIT {
+		t.Errorf("ParseLevel: got %v (%v) for a custom level", lvl, err)
+	}
+
+	w := new(recordingWriter)
+	l := NewLogger().AddFilter("audit", AUDIT, w)
+	l.Critical("not audited")
+	l.Log(AUDIT, "source", "audited")
+	if recs := w.records(); len(recs) != 1 {
+		t.Fatalf("RegisterLevel: expected 1 record, found %d", len(recs))
+	} else if got := FormatLogRecord("%L %l %M", recs[0]); got != "AUDT AUDIT audited\n" {
+		t.Errorf("FormatLogRecord: got %q for a custom level", got)
+	} else if parsed, err := ParseLogfmt(string(LogfmtFormatter{}.Format(recs[0], nil))); err != nil || parsed.Level != AUDIT {
+		t.Errorf("ParseLogfmt: got %+v (%v) for a custom level", parsed, err)
+	}
+}
+
+func TestRecordQueue(t *testing.T) {
+	recs := make([]*LogRecord, 4)
+	for i := range recs {
+		recs[i] = &LogRecord{Level: INFO, Message: fmt.Sprint(i)}
+	}
+	drain := func(q *recordQueue) (msgs []string) {
+		for len(q.ch) > 0 {
+			msgs = append(msgs, (<-q.ch).Message)
+		}
+		return msgs
+	}
+
+	for _, test := range []struct {
+		overflow Overflow
+		want     string
+	}{
+		{Overflow{Policy: DropNewest}, "0,1"},
+		{Overflow{Policy: DropOldest}, "2,3"},
+		{Overflow{Policy: BlockTimeout, Timeout: time.Millisecond}, "0,1"},
+		{Overflow{Policy: DropBelowLevel, Level: WARNING}, "0,1"},
+	} {
+		q := newRecordQueue(2)
+		q.SetOverflow(test.overflow)
+		for _, rec := range recs {
+			q.put(rec)
+		}
+		if got := strings.Join(drain(q), ","); got != test.want || q.Dropped() != 2 {
+			t.Errorf("%s: queued %q and dropped %d, want %q and 2", test.overflow.Policy, got, q.Dropped(), test.want)
+		}
+	}
+
+	// Records at or above the level wait for room
+	q := newRecordQueue(1)
+	q.SetOverflow(Overflow{Policy: DropBelowLevel, Level: WARNING})
+	q.put(recs[0])
+	q.put(recs[1])
+	done := make(chan bool)
+	go func() {
+		q.put(&LogRecord{Level: ERROR, Message: "important"})
+		close(done)
+	}()
+	if got := (<-q.ch).Message; got != "0" {
+		t.Errorf("DropBelowLevel: got %q first", got)
+	}
+	<-done
+	if got := (<-q.ch).Message; got != "important" {
+		t.Errorf("DropBelowLevel: got %q, want the ERROR record", got)
+	}
+
+	// Once there is room, the losses are reported
+	q = newRecordQueue(2)
+	q.SetOverflow(Overflow{Policy: DropNewest, ReportLoss: true})
+	for _, rec := range recs[:3] {
+		q.put(rec)
+	}
+	drain(q)
+	q.put(recs[3])
+	if got := strings.Join(drain(q), ","); got != "dropped 1 records because the queue was full,3" {
+		t.Errorf("ReportLoss: got %q", got)
+	}
+}
+
+func TestLogCtx(t *testing.T) {
+	w := new(recordingWriter)
+	l := NewLogger().AddFilter("rec", FINEST, w).With(String("service", "api"))
+
+	ctx := ContextWithFields(context.Background(), String("request", "abc"))
+	ctx = ContextWithFields(ctx, Int("user", 7))
+	ctx, err := ContextWithTraceParent(ctx, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatalf("ContextWithTraceParent: %s", err)
+	}
+
+	l.InfoCtx(ctx, "handled %s", "/index")
+	if err := l.ErrorCtx(ctx, "failed: %d", 500); err.Error() != "failed: 500" {
+		t.Errorf("ErrorCtx returned invalid error: %s", err)
+	}
+	l.LogCtx(context.Background(), DEBUG, "no context values")
+
+	recs := w.records()
+	if len(recs) != 3 {
+		t.Fatalf("LogCtx: expected 3 records, found %d", len(recs))
+	}
+	const format = "%I/%i %X %M"
+	for i, want := range []string{
+		"4bf92f3577b34da6a3ce929d0e0e4736/00f067aa0ba902b7 service=api request=abc user=7 handled /index\n",
+		"4bf92f3577b34da6a3ce929d0e0e4736/00f067aa0ba902b7 service=api request=abc user=7 failed: 500\n",
+		"/ service=api no context values\n",
+	} {
+		if got := FormatLogRecord(format, recs[i]); got != want {
+			t.Errorf("LogCtx: record %d: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		in            string
+		trace, span   string
+		expectFailure bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "", "", true},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", "", true},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", "", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", "", "", true},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "", "", true},
+		{"garbage", "", "", true},
+	}
+	for _, test := range tests {
+		trace, span, err := ParseTraceParent(test.in)
+		if (err != nil) != test.expectFailure {
+			t.Errorf("ParseTraceParent(%q): unexpected error state %v", test.in, err)
+			continue
+		}
+		if trace != test.trace || span != test.span {
+			t.Errorf("ParseTraceParent(%q) = %q, %q; want %q, %q", test.in, trace, span, test.trace, test.span)
+		}
+	}
+}
+
 func TestLogOutput(t *testing.T) {
 	const (
 		expected = "fdf3e51e444da56b4cb400f30bc47424"
@@ -226,7 +1718,7 @@ func TestLogOutput(t *testing.T) {
 	}(LogBufferLength)
 	LogBufferLength = 0
 
-	l := make(Logger)
+	l := NewLogger()
 
 	// Delete and open the output log without a timestamp (for a constant md5sum)
 	l.AddFilter("file", FINEST, NewFileLogWriter(testLogFile, false).SetFormat("[%L] %M"))
@@ -259,46 +1751,31 @@ func TestLogOutput(t *testing.T) {
 }
 
 func TestCountMallocs(t *testing.T) {
-	const N = 1
-	var m runtime.MemStats
-	getMallocs := func() uint64 {
-		runtime.ReadMemStats(&m)
-		return m.Mallocs
-	}
-
-	// Console logger
-	sl := NewDefaultLogger(INFO)
-	mallocs := 0 - getMallocs()
-	for i := 0; i < N; i++ {
-		sl.Log(WARNING, "here", "This is a WARNING message")
-	}
-	mallocs += getMallocs()
-	fmt.Printf("mallocs per sl.Log((WARNING, \"here\", \"This is a log message\"): %d\n", mallocs/N)
-
-	// Console logger formatted
-	mallocs = 0 - getMallocs()
-	for i := 0; i < N; i++ {
-		sl.Logf(WARNING, "%s is a log message with level %d", "This", WARNING)
-	}
-	mallocs += getMallocs()
-	fmt.Printf("mallocs per sl.Logf(WARNING, \"%%s is a log message with level %%d\", \"This\", WARNING): %d\n", mallocs/N)
-
-	// Console logger (not logged)
-	sl = NewDefaultLogger(INFO)
-	mallocs = 0 - getMallocs()
-	for i := 0; i < N; i++ {
-		sl.Log(DEBUG, "here", "This is a DEBUG log message")
-	}
-	mallocs += getMallocs()
-	fmt.Printf("mallocs per unlogged sl.Log((WARNING, \"here\", \"This is a log message\"): %d\n", mallocs/N)
-
-	// Console logger formatted (not logged)
-	mallocs = 0 - getMallocs()
-	for i := 0; i < N; i++ {
-		sl.Logf(DEBUG, "%s is a log message with level %d", "This", DEBUG)
+	l := NewLogger().AddFilter("discard", INFO, NewFormatLogWriter(ioutil.Discard, FORMAT_DEFAULT))
+	defer l.Close()
+
+	for _, test := range []struct {
+		name string
+		max  float64
+		log  func()
+	}{
+		// Disabled levels cost nothing
+		{"unlogged Log", 0, func() { l.Log(DEBUG, "here", "This is a DEBUG log message") }},
+		{"unlogged Logf", 0, func() { l.Logf(DEBUG, "%s is a log message with level %d", "This", DEBUG) }},
+		{"unlogged Logc", 0, func() { l.Logc(DEBUG, func() string { return "This is a DEBUG log message" }) }},
+		{"unlogged Debug", 0, func() { l.Debug("%s is a log message with level %d", "This", DEBUG) }},
+
+		// Records and buffers are reused, so only formatting a message
+		// allocates (its arguments too under the race detector)
+		{"Log", 0, func() { l.Log(WARNING, "here", "This is a WARNING message") }},
+		{"Logf", 0, func() { l.Logf(WARNING, "This is a WARNING message") }},
+		{"Info", 0, func() { l.Info("This is an INFO message") }},
+		{"formatted Logf", 2, func() { l.Logf(WARNING, "%s is a log message with level %d", "This", WARNING) }},
+	} {
+		if mallocs := testing.AllocsPerRun(1000, test.log); mallocs > test.max {
+			t.Errorf("%s: %v mallocs per call, want at most %v", test.name, mallocs, test.max)
+		}
 	}
-	mallocs += getMallocs()
-	fmt.Printf("mallocs per unlogged sl.Logf(WARNING, \"%%s is a log message with level %%d\", \"This\", WARNING): %d\n", mallocs/N)
 }
 
 func TestXMLConfig(t *testing.T) {
@@ -315,8 +1792,18 @@ func TestXMLConfig(t *testing.T) {
 	fmt.Fprintln(fd, "  <filter enabled=\"true\">")
 	fmt.Fprintln(fd, "    <tag>stdout</tag>")
 	fmt.Fprintln(fd, "    <type>console</type>")
+	fmt.Fprintln(fd, "    <property name=\"color\">auto</property> <!-- (:?never|auto|always); auto colors terminals unless NO_COLOR is set -->")
+	fmt.Fprintln(fd, "    <property name=\"palette\">INFO=32,WARNING=1;33</property> <!-- level=ANSI color codes, changing the default palette -->")
+	fmt.Fprintln(fd, "    <property name=\"colorverbs\">LM</property> <!-- Verbs of the format to color; empty colors whole records -->")
+	fmt.Fprintln(fd, "    <property name=\"target\">stdout</property> <!-- (:?stdout|stderr|split); split writes records from splitlevel up to stderr -->")
+	fmt.Fprintln(fd, "    <property name=\"splitlevel\">WARNING</property>")
+	fmt.Fprintln(fd, "    <property name=\"sync\">false</property> <!-- true writes records before the log call returns -->")
 	fmt.Fprintln(fd, "    <!-- level is (:?FINEST|FINE|DEBUG|TRACE|INFO|WARNING|ERROR) -->")
 	fmt.Fprintln(fd, "    <level>DEBUG</level>")
+	fmt.Fprintln(fd, "    <dedup window=\"30s\"/> <!-- Optional: collapses identical consecutive records into \"last message repeated N times\" -->")
+	fmt.Fprintln(fd, "    <!-- Optional: how records are written; type is (:?pattern|json|xml|logfmt), and format is the format of pattern,")
+	fmt.Fprintln(fd, "         whose times are in location (such as UTC, Local or America/New_York) if it is set -->")
+	fmt.Fprintf(fd, "%s\n", "    <formatter type=\"pattern\" format=\"[%D %T] [%L] (%S) %M\" location=\"UTC\"/>")
 	fmt.Fprintln(fd, "  </filter>")
 	fmt.Fprintln(fd, "  <filter enabled=\"true\">")
 	fmt.Fprintln(fd, "    <tag>file</tag>")
@@ -324,17 +1811,22 @@ func TestXMLConfig(t *testing.T) {
 	fmt.Fprintln(fd, "    <level>FINEST</level>")
 	fmt.Fprintln(fd, "    <property name=\"filename\">test.log</property>")
 	fmt.Fprintln(fd, "    <!--")
-	fmt.Fprintln(fd, "       %T - Time (15:04:05 MST)")
-	fmt.Fprintln(fd, "       %t - Time (15:04)")
+	fmt.Fprintf(fd, "%s\n", "       %T - Time (15:04:05 MST)")
+	fmt.Fprintf(fd, "%s\n", "       %t - Time (15:04)")
 	fmt.Fprintln(fd, "       %D - Date (2006/01/02)")
-	fmt.Fprintln(fd, "       %d - Date (01/02/06)")
+	fmt.Fprintf(fd, "%s\n", "       %d - Date (02/01/06, day first)")
+	fmt.Fprintf(fd, "%s\n", "       %q - Milliseconds (000-999); %u and %N for microseconds and nanoseconds")
+	fmt.Fprintln(fd, "       %Y - ISO 8601 time (2006-01-02T15:04:05.000Z07:00)")
+	fmt.Fprintf(fd, "%s\n", "       %e - Seconds since the epoch; %E for milliseconds")
+	fmt.Fprintln(fd, "       %{layout}T - Time in a Go layout such as 2006-01-02 15:04:05.000, or a name such as RFC3339")
 	fmt.Fprintln(fd, "       %L - Level (FNST, FINE, DEBG, TRAC, WARN, EROR, CRIT)")
 	fmt.Fprintln(fd, "       %S - Source")
 	fmt.Fprintln(fd, "       %M - Message")
-	fmt.Fprintln(fd, "       It ignores unknown format strings (and removes them)")
-	fmt.Fprintln(fd, "       Recommended: \"[%D %T] [%L] (%S) %M\"")
+	fmt.Fprintln(fd, "       Modifiers such as %-8L (pad on the right), %20S (pad on the left), %.20S (keep the last 20) and %.-20S (keep the first 20)")
+	fmt.Fprintln(fd, "       Unknown format strings are an error")
+	fmt.Fprintf(fd, "%s\n", "       Recommended: \"[%D %T] [%L] (%S) %M\"")
 	fmt.Fprintln(fd, "    -->")
-	fmt.Fprintln(fd, "    <property name=\"format\">[%D %T] [%L] (%S) %M</property>")
+	fmt.Fprintf(fd, "%s\n", "    <property name=\"format\">[%D %T] [%L] (%S) %M</property>")
 	fmt.Fprintln(fd, "    <property name=\"rotate\">false</property> <!-- true enables log rotation, otherwise append -->")
 	fmt.Fprintln(fd, "    <property name=\"maxsize\">0M</property> <!-- \\d+[KMG]? Suffixes are in terms of 2**10 -->")
 	fmt.Fprintln(fd, "    <property name=\"maxlines\">0K</property> <!-- \\d+[KMG]? Suffixes are in terms of thousands -->")
@@ -349,6 +1841,12 @@ func TestXMLConfig(t *testing.T) {
 	fmt.Fprintln(fd, "    <property name=\"maxsize\">100M</property> <!-- \\d+[KMG]? Suffixes are in terms of 2**10 -->")
 	fmt.Fprintln(fd, "    <property name=\"maxrecords\">6K</property> <!-- \\d+[KMG]? Suffixes are in terms of thousands -->")
 	fmt.Fprintln(fd, "    <property name=\"daily\">false</property> <!-- Automatically rotates when a log message is written after midnight -->")
+	fmt.Fprintln(fd, "    <!-- Optional sampling of each source and level (the first N per interval, then every Mth) and rate limiting")
+	fmt.Fprintln(fd, "         (records per second, with bursts); suppressed records are counted in a periodic summary record -->")
+	fmt.Fprintln(fd, "    <!-- Optional: what to do when the queue of the writer is full; policy is (:?block|block-timeout|drop-newest|drop-oldest|drop-below-level),")
+	fmt.Fprintln(fd, "         timeout applies to block-timeout and level to drop-below-level; report-loss=true writes the number of records dropped -->")
+	fmt.Fprintln(fd, "    <overflow policy=\"drop-below-level\" level=\"WARNING\" report-loss=\"true\"/>")
+	fmt.Fprintln(fd, "    <limit sample-interval=\"1s\" first=\"100\" thereafter=\"10\" rate=\"1000\" burst=\"2000\" report=\"1m\"/>")
 	fmt.Fprintln(fd, "  </filter>")
 	fmt.Fprintln(fd, "  <filter enabled=\"false\"><!-- enabled=false means this logger won't actually be created -->")
 	fmt.Fprintln(fd, "    <tag>donotopen</tag>")
@@ -356,61 +1854,97 @@ func TestXMLConfig(t *testing.T) {
 	fmt.Fprintln(fd, "    <level>FINEST</level>")
 	fmt.Fprintln(fd, "    <property name=\"endpoint\">192.168.1.255:12124</property> <!-- recommend UDP broadcast -->")
 	fmt.Fprintln(fd, "    <property name=\"protocol\">udp</property> <!-- tcp or udp -->")
+	fmt.Fprintln(fd, "    <!-- Optional: keys of the json formatter (time-key, level-key, message-key, source-key, logger-key, fields-key),")
+	fmt.Fprintln(fd, "         time-layout (a Go layout, a name such as RFC3339, or unix, unixmilli, unixmicro or unixnano),")
+	fmt.Fprintln(fd, "         level-style (:?name|short|number) and flatten (true puts fields at the top level) -->")
+	fmt.Fprintln(fd, "    <formatter type=\"json\" time-key=\"@timestamp\" level-key=\"severity\" time-layout=\"RFC3339Nano\" level-style=\"name\"/>")
 	fmt.Fprintln(fd, "  </filter>")
+	fmt.Fprintln(fd, "  <!-- Named loggers (see GetLogger) inherit their level from their parents and write to their filters;")
+	fmt.Fprintln(fd, "       filters referenced with <filter-ref>tag</filter-ref> are added to that logger instead of the root.")
+	fmt.Fprintln(fd, "       additivity=false stops records from reaching the filters of the parents. -->")
+	fmt.Fprintln(fd, "  <logger name=\"app.db\" level=\"INFO\" additivity=\"true\"></logger>")
+	fmt.Fprintln(fd, "  <!-- Per-source level overrides matched against the package or file of the caller (see SetVModule);")
+	fmt.Fprintln(fd, "       without it, the rules of the logger, including those from LOG4GO_VMODULE, are removed")
+	fmt.Fprintln(fd, "  <vmodule>mypkg/storage=FINEST,net/*=WARNING</vmodule> -->")
 	fmt.Fprintln(fd, "</logging>")
 	fd.Close()
 
-	log := make(Logger)
+	log := NewLogger()
 	log.LoadConfiguration(configfile)
 	defer os.Remove("trace.xml")
 	defer os.Remove("test.log")
 	defer log.Close()
+	filters := log.Filters()
 
 	// Make sure we got all loggers
-	if len(log) != 3 {
-		t.Fatalf("XMLConfig: Expected 3 filters, found %d", len(log))
+	if len(filters) != 3 {
+		t.Fatalf("XMLConfig: Expected 3 filters, found %d", len(filters))
 	}
 
 	// Make sure they're the right keys
-	if _, ok := log["stdout"]; !ok {
+	if _, ok := filters["stdout"]; !ok {
 		t.Errorf("XMLConfig: Expected stdout logger")
 	}
-	if _, ok := log["file"]; !ok {
+	if _, ok := filters["file"]; !ok {
 		t.Fatalf("XMLConfig: Expected file logger")
 	}
-	if _, ok := log["xmllog"]; !ok {
+	if _, ok := filters["xmllog"]; !ok {
 		t.Fatalf("XMLConfig: Expected xmllog logger")
 	}
 
 	// Make sure they're the right type
-	if _, ok := log["stdout"].LogWriter.(ConsoleLogWriter); !ok {
-		t.Fatalf("XMLConfig: Expected stdout to be ConsoleLogWriter, found %T", log["stdout"].LogWriter)
+	if d, ok := filters["stdout"].LogWriter.(*DedupLogWriter); !ok || d.window != 30*time.Second {
+		t.Fatalf("XMLConfig: Expected stdout to be deduplicated, found %T", filters["stdout"].LogWriter)
+	} else if c, ok := d.w.(*ConsoleLogWriter); !ok {
+		t.Fatalf("XMLConfig: Expected stdout to be ConsoleLogWriter, found %T", d.w)
+	} else if f, ok := c.formatter.Load().(*PatternFormatter); !ok || f.String() != FORMAT_DEFAULT || f.Location() != time.UTC {
+		t.Errorf("XMLConfig: Expected stdout to have formatter %q, found %v", FORMAT_DEFAULT, c.formatter.Load())
 	}
-	if _, ok := log["file"].LogWriter.(*FileLogWriter); !ok {
-		t.Fatalf("XMLConfig: Expected file to be *FileLogWriter, found %T", log["file"].LogWriter)
+	if _, ok := filters["file"].LogWriter.(*FileLogWriter); !ok {
+		t.Fatalf("XMLConfig: Expected file to be *FileLogWriter, found %T", filters["file"].LogWriter)
 	}
-	if _, ok := log["xmllog"].LogWriter.(*FileLogWriter); !ok {
-		t.Fatalf("XMLConfig: Expected xmllog to be *FileLogWriter, found %T", log["xmllog"].LogWriter)
+	if _, ok := filters["xmllog"].LogWriter.(*FileLogWriter); !ok {
+		t.Fatalf("XMLConfig: Expected xmllog to be *FileLogWriter, found %T", filters["xmllog"].LogWriter)
 	}
 
 	// Make sure levels are set
-	if lvl := log["stdout"].Level; lvl != DEBUG {
+	if lvl := filters["stdout"].Level(); lvl != DEBUG {
 		t.Errorf("XMLConfig: Expected stdout to be set to level %d, found %d", DEBUG, lvl)
 	}
-	if lvl := log["file"].Level; lvl != FINEST {
+	if lvl := filters["file"].Level(); lvl != FINEST {
 		t.Errorf("XMLConfig: Expected file to be set to level %d, found %d", FINEST, lvl)
 	}
-	if lvl := log["xmllog"].Level; lvl != TRACE {
+	if lvl := filters["xmllog"].Level(); lvl != TRACE {
 		t.Errorf("XMLConfig: Expected xmllog to be set to level %d, found %d", TRACE, lvl)
 	}
 
+	// Make sure limits are set
+	want := Limits{SampleInterval: time.Second, SampleFirst: 100, SampleThereafter: 10, Rate: 1000, Burst: 2000, ReportInterval: time.Minute}
+	if limits := filters["xmllog"].Limits(); limits == nil || *limits != want {
+		t.Errorf("XMLConfig: Expected xmllog to have limits %+v, found %+v", want, limits)
+	}
+	if limits := filters["file"].Limits(); limits != nil {
+		t.Errorf("XMLConfig: Expected file to have no limits, found %+v", limits)
+	}
+
+	// Make sure overflow policies are set
+	wantOverflow := Overflow{Policy: DropBelowLevel, Level: WARNING, ReportLoss: true}
+	if overflow := filters["xmllog"].LogWriter.(*FileLogWriter).overflow.Load(); overflow != wantOverflow {
+		t.Errorf("XMLConfig: Expected xmllog to have overflow %+v, found %+v", wantOverflow, overflow)
+	}
+
+	// Make sure named loggers are configured
+	if lvl := log.GetLogger("app.db").Threshold(); lvl != INFO {
+		t.Errorf("XMLConfig: Expected logger app.db to be set to level %d, found %d", INFO, lvl)
+	}
+
 	// Make sure the w is open and points to the right file
-	if fname := log["file"].LogWriter.(*FileLogWriter).file.Name(); fname != "test.log" {
+	if fname := filters["file"].LogWriter.(*FileLogWriter).file.Name(); fname != "test.log" {
 		t.Errorf("XMLConfig: Expected file to have opened %s, found %s", "test.log", fname)
 	}
 
 	// Make sure the XLW is open and points to the right file
-	if fname := log["xmllog"].LogWriter.(*FileLogWriter).file.Name(); fname != "trace.xml" {
+	if fname := filters["xmllog"].LogWriter.(*FileLogWriter).file.Name(); fname != "trace.xml" {
 		t.Errorf("XMLConfig: Expected xmllog to have opened %s, found %s", "trace.xml", fname)
 	}
 
@@ -436,6 +1970,19 @@ func BenchmarkFormatLogRecord(b *testing.B) {
 	}
 }
 
+func BenchmarkFormatter(b *testing.B) {
+	f, err := CompileFormat(FORMAT_DEFAULT)
+	if err != nil {
+		b.Fatal(err)
+	}
+	rec := newLogRecord(CRITICAL, "source", "message")
+	var buf []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = f.Format(rec, buf[:0])
+	}
+}
+
 func BenchmarkConsoleLog(b *testing.B) {
 	/* This doesn't seem to work on OS X
 	sink, err := os.Open(os.DevNull)
@@ -476,7 +2023,7 @@ func BenchmarkConsoleUtilNotLog(b *testing.B) {
 }
 
 func BenchmarkFileLog(b *testing.B) {
-	sl := make(Logger)
+	sl := NewLogger()
 	b.StopTimer()
 	sl.AddFilter("file", INFO, NewFileLogWriter("benchlog.log", false))
 	b.StartTimer()
@@ -488,7 +2035,7 @@ func BenchmarkFileLog(b *testing.B) {
 }
 
 func BenchmarkFileNotLogged(b *testing.B) {
-	sl := make(Logger)
+	sl := NewLogger()
 	b.StopTimer()
 	sl.AddFilter("file", INFO, NewFileLogWriter("benchlog.log", false))
 	b.StartTimer()
@@ -500,7 +2047,7 @@ func BenchmarkFileNotLogged(b *testing.B) {
 }
 
 func BenchmarkFileUtilLog(b *testing.B) {
-	sl := make(Logger)
+	sl := NewLogger()
 	b.StopTimer()
 	sl.AddFilter("file", INFO, NewFileLogWriter("benchlog.log", false))
 	b.StartTimer()
@@ -512,7 +2059,7 @@ func BenchmarkFileUtilLog(b *testing.B) {
 }
 
 func BenchmarkFileUtilNotLog(b *testing.B) {
-	sl := make(Logger)
+	sl := NewLogger()
 	b.StopTimer()
 	sl.AddFilter("file", INFO, NewFileLogWriter("benchlog.log", false))
 	b.StartTimer()
@@ -3,11 +3,15 @@
 package log4go
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -16,115 +20,561 @@ const (
 	FORMAT_ABBREV  = "[%L] %M"
 )
 
-type formatCacheType struct {
-	LastUpdateSeconds    int64
-	shortTime, shortDate string
-	longTime, longDate   string
-}
-
-var formatCache = &formatCacheType{}
-var logMutex sync.Mutex
-
 // Known format codes:
 // %T - Time (15:04:05 MST)
 // %t - Time (15:04)
 // %D - Date (2006/01/02)
-// %d - Date (01/02/06)
+// %d - Date (02/01/06, day first)
+// %q - Milliseconds of the second (000-999)
+// %u - Microseconds of the second (000000-999999)
+// %N - Nanoseconds of the second (000000000-999999999)
+// %Y - ISO 8601 (RFC 3339) time with milliseconds (2006-01-02T15:04:05.000Z07:00)
+// %e - Seconds since the Unix epoch
+// %E - Milliseconds since the Unix epoch
+// %{layout}T - Time in a Go layout, such as %{2006-01-02 15:04:05.000000}T
+// %{name}T - Time in a layout named in TimeLayouts, such as %{RFC3339Nano}T
 // %L - Level (FNST, FINE, DEBG, TRAC, WARN, EROR, CRIT)
-// %S - Source
+// %l - Level name (FINEST, FINE, DEBUG, TRACE, INFO, WARNING, ERROR, CRITICAL)
+// %S - Source (function:line)
+// %s - Short source (function without its package path:line)
+// %F - File (full path:line)
+// %f - File (base name:line)
+// %P - Package
 // %M - Message
-// Ignores unknown formats
+// %c - Logger name (see GetLogger)
+// %X - Fields (key=value, separated by spaces)
+// %X{key} - Value of the named field
+// %I - Trace ID
+// %i - Span ID
+// %K - Stack trace (see SetStackTrace), on lines of its own; use as in "%M%K"
+// %% - A percent sign
+// Modifiers between the % and the verb (or the {layout} of %T) set the width
+// and precision of what a verb formats, as in log4j:
+// %8L - Padded with spaces on the left to at least 8 characters
+// %-8L - Padded on the right instead
+// %.20S - Truncated to its last 20 characters
+// %.-20S - Truncated to its first 20 characters
+// %-20.20S - Padded or truncated to exactly 20 characters
+// Times are in the location of the record (see PatternFormatter.In)
+// Ignores unknown formats (CompileFormat reports them)
 // Recommended: "[%D %T] [%L] (%S) %M"
 func FormatLogRecord(format string, rec *LogRecord) string {
-	if rec == nil {
-		return "<nil>"
+	buf := getBuffer()
+	*buf = lookupFormatter(format).Format(rec, *buf)
+	s := string(*buf)
+	putBuffer(buf)
+	return s
+}
+
+// The verbs of formats, as listed above
+const formatVerbs = "TtDdquNYeELlSsFfPMcXIiK"
+
+// A PatternFormatter is a Formatter which renders log records according to a
+// format of the verbs listed for FormatLogRecord, which CompileFormat parses
+// once.
+type PatternFormatter struct {
+	format  string
+	parts   []formatPart
+	layouts []timeLayout            // of the parts which format times
+	loc     *time.Location          // nil for the location of each record
+	times   atomicValue[*timeCache] // of the last second formatted
+}
+
+// A piece of a compiled format: a verb, or literal text if verb is zero.  The
+// text of %X{key} is the key.  Verbs which format times in a layout format it
+// in layouts[layout].  What the verb formats is padded to width and truncated
+// to precision characters, if they are not zero.
+type formatPart struct {
+	verb   byte
+	text   string
+	layout int
+
+	width, precision int
+	leftAlign        bool // pad on the right
+	keepHead         bool // truncate the end rather than the start
+}
+
+// The layouts of the verbs which format times in one
+var verbLayouts = map[byte]string{
+	'T': "15:04:05 MST",
+	't': "15:04",
+	'D': "2006/01/02",
+	'd': "02/01/06",
+	'Y': "2006-01-02T15:04:05.000Z07:00",
+}
+
+// A time layout, split around its fractions of a second, so that the rest of
+// it is formatted once per second: the fractions go between the parts of rest,
+// which has one part more
+type timeLayout struct {
+	layout string
+	rest   []string
+	fracs  []string
+}
+
+// The layouts of a PatternFormatter, but for their fractions of a second,
+// formatted for one second: the parts of the rest of each
+type timeCache struct {
+	secs  int64
+	texts [][]string
+}
+
+// CompileFormat parses format (see FormatLogRecord for its verbs) into a
+// PatternFormatter.  Unknown verbs and a malformed %X{key} are errors.
+func CompileFormat(format string) (*PatternFormatter, error) {
+	return compileFormat(format, true)
+}
+
+// Compile format, ignoring what is wrong with it (as FormatLogRecord always
+// did) unless strict is set
+func compileFormat(format string, strict bool) (*PatternFormatter, error) {
+	f := &PatternFormatter{format: format}
+	var text []byte
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			text = append(text, format[i])
+			continue
+		}
+		i++
+		if i == len(format) {
+			if strict {
+				return nil, fmt.Errorf("log4go: format %q ends with a lone %%", format)
+			}
+			break
+		}
+		if format[i] == '%' {
+			text = append(text, '%')
+			continue
+		}
+
+		// Width and precision
+		var part formatPart
+		if format[i] == '-' {
+			part.leftAlign = true
+			i++
+		}
+		i, part.width = parseWidth(format, i)
+		if i < len(format) && format[i] == '.' {
+			i++
+			if i < len(format) && format[i] == '-' {
+				part.keepHead = true
+				i++
+			}
+			start := i
+			if i, part.precision = parseWidth(format, i); i == start && strict {
+				return nil, fmt.Errorf("log4go: missing precision in format %q", format)
+			}
+		}
+		if i == len(format) {
+			if strict {
+				return nil, fmt.Errorf("log4go: format %q ends with an incomplete verb", format)
+			}
+			break
+		}
+
+		// %{layout}T
+		var layout string
+		if format[i] == '{' {
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 || i+end+1 == len(format) {
+				if strict {
+					return nil, fmt.Errorf("log4go: malformed %%{layout} in format %q", format)
+				}
+				continue
+			}
+			layout = format[i+1 : i+end]
+			i += end + 1
+			if named, ok := TimeLayouts[layout]; ok {
+				layout = named
+			}
+			if format[i] != 'T' || len(layout) == 0 {
+				if strict {
+					return nil, fmt.Errorf("log4go: %%{layout} must be a non-empty layout of %%T in format %q", format)
+				}
+				layout = ""
+			}
+		}
+
+		verb := format[i]
+		if strings.IndexByte(formatVerbs, verb) < 0 {
+			if strict {
+				return nil, fmt.Errorf("log4go: unknown verb %%%c in format %q", verb, format)
+			}
+			continue
+		}
+		if len(text) > 0 {
+			f.parts = append(f.parts, formatPart{text: string(text)})
+			text = text[:0]
+		}
+		part.verb = verb
+		if len(layout) == 0 {
+			layout = verbLayouts[verb]
+		}
+		if len(layout) > 0 {
+			part.layout = f.addLayout(layout)
+		}
+		if verb == 'X' && i+1 < len(format) && format[i+1] == '{' {
+			if end := strings.IndexByte(format[i+1:], '}'); end > 1 {
+				part.text = format[i+2 : i+1+end]
+				i += 1 + end
+			} else if strict {
+				return nil, fmt.Errorf("log4go: malformed %%X{key} in format %q", format)
+			}
+		}
+		f.parts = append(f.parts, part)
 	}
-	if len(format) == 0 {
-		return ""
+	if len(text) > 0 {
+		f.parts = append(f.parts, formatPart{text: string(text)})
 	}
+	return f, nil
+}
+
+// Parse the decimal number at format[i:], if any, returning the index after it
+func parseWidth(format string, i int) (int, int) {
+	n := 0
+	for ; i < len(format) && '0' <= format[i] && format[i] <= '9'; i++ {
+		if n < maxWidth {
+			n = n*10 + int(format[i]-'0')
+		}
+	}
+	if n > maxWidth {
+		n = maxWidth
+	}
+	return i, n
+}
+
+// Widths and precisions are limited to this
+const maxWidth = 1 << 10
 
-	out := bytes.NewBuffer(make([]byte, 0, 64))
-	secs := rec.Created.UnixNano() / 1e9
+// Add layout to those of the formatter, unless it is there already, and return
+// its index
+func (f *PatternFormatter) addLayout(layout string) int {
+	for i, known := range f.layouts {
+		if known.layout == layout {
+			return i
+		}
+	}
 
-	logMutex.Lock()
-	cache := *formatCache
-	if cache.LastUpdateSeconds != secs {
-		month, day, year := rec.Created.Month(), rec.Created.Day(), rec.Created.Year()
-		hour, minute, second := rec.Created.Hour(), rec.Created.Minute(), rec.Created.Second()
-		zone, _ := rec.Created.Zone()
-		updated := &formatCacheType{
-			LastUpdateSeconds: secs,
-			shortTime:         fmt.Sprintf("%02d:%02d", hour, minute),
-			shortDate:         fmt.Sprintf("%02d/%02d/%02d", day, month, year%100),
-			longTime:          fmt.Sprintf("%02d:%02d:%02d %s", hour, minute, second, zone),
-			longDate:          fmt.Sprintf("%04d/%02d/%02d", year, month, day),
+	l := timeLayout{layout: layout}
+	start := 0
+	for i := 0; i+1 < len(layout); i++ {
+		// As the time package reads fractions of a second
+		if c := layout[i+1]; (layout[i] == '.' || layout[i] == ',') && (c == '0' || c == '9') {
+			j := i + 1
+			for j < len(layout) && layout[j] == c {
+				j++
+			}
+			if j < len(layout) && '0' <= layout[j] && layout[j] <= '9' {
+				continue
+			}
+			l.rest = append(l.rest, layout[start:i])
+			l.fracs = append(l.fracs, layout[i:j])
+			start, i = j, j-1
 		}
-		cache = *updated
-		formatCache = updated
 	}
-	logMutex.Unlock()
+	l.rest = append(l.rest, layout[start:])
+	f.layouts = append(f.layouts, l)
+	return len(f.layouts) - 1
+}
 
-	// Split the string into pieces by % signs
-	pieces := bytes.Split([]byte(format), []byte{'%'})
+// In returns a formatter with the format of f which formats times in loc, such
+// as time.UTC, instead of the location of each record; a nil loc returns one
+// which uses the location of each record.
+func (f *PatternFormatter) In(loc *time.Location) *PatternFormatter {
+	return &PatternFormatter{format: f.format, parts: f.parts, layouts: f.layouts, loc: loc}
+}
 
-	// Iterate over the pieces, replacing known formats
-	for i, piece := range pieces {
-		if i > 0 && len(piece) > 0 {
-			switch piece[0] {
-			case 'T':
-				out.WriteString(cache.longTime)
-			case 't':
-				out.WriteString(cache.shortTime)
-			case 'D':
-				out.WriteString(cache.longDate)
-			case 'd':
-				out.WriteString(cache.shortDate)
-			case 'L':
-				out.WriteString(levelStrings[rec.Level])
-			case 'S':
-				out.WriteString(rec.Source)
-			case 's':
-				slice := strings.Split(rec.Source, "/")
-				out.WriteString(slice[len(slice)-1])
-			case 'M':
-				out.WriteString(rec.Message)
+// Location returns the location the formatter formats times in, or nil if it
+// uses the location of each record.
+func (f *PatternFormatter) Location() *time.Location {
+	return f.loc
+}
+
+// String returns the format the PatternFormatter was compiled from.
+func (f *PatternFormatter) String() string {
+	return f.format
+}
+
+// Format appends rec, formatted and followed by a newline, to buf and returns
+// the extended buffer.  It does not allocate unless buf needs to grow.  An
+// empty format formats nothing.
+func (f *PatternFormatter) Format(rec *LogRecord, buf []byte) []byte {
+	if rec == nil {
+		return append(buf, "<nil>"...)
+	}
+	if len(f.format) == 0 {
+		return buf
+	}
+	return append(f.appendParts(buf, rec, "", ""), '\n')
+}
+
+// Format rec as Format does, in the colors of p
+func (f *PatternFormatter) formatColored(rec *LogRecord, buf []byte, p *painter) []byte {
+	if rec == nil || len(f.format) == 0 {
+		return f.Format(rec, buf)
+	}
+	color := p.palette[rec.Level]
+	if len(color) == 0 {
+		return f.Format(rec, buf)
+	}
+	if len(p.verbs) == 0 {
+		buf = appendColor(buf, color)
+		buf = f.appendParts(buf, rec, "", "")
+		buf = append(buf, colorReset...)
+		return append(buf, '\n')
+	}
+	return append(f.appendParts(buf, rec, color, p.verbs), '\n')
+}
+
+// Append rec, formatted, to buf, coloring the text of the given verbs with the
+// escape sequence parameters color
+func (f *PatternFormatter) appendParts(buf []byte, rec *LogRecord, color, verbs string) []byte {
+	created := rec.Created
+	if f.loc != nil {
+		created = created.In(f.loc)
+	}
+	var times *timeCache
+	for i := range f.parts {
+		part := &f.parts[i]
+		colored := len(color) > 0 && part.verb != 0 && strings.IndexByte(verbs, part.verb) >= 0
+		if colored {
+			buf = appendColor(buf, color)
+		}
+		start := len(buf)
+		switch part.verb {
+		case 0:
+			buf = append(buf, part.text...)
+		case 'T', 't', 'D', 'd', 'Y':
+			if times == nil {
+				times = f.timesOf(created)
 			}
-			if len(piece) > 1 {
-				out.Write(piece[1:])
+			texts := times.texts[part.layout]
+			for k, frac := range f.layouts[part.layout].fracs {
+				buf = append(buf, texts[k]...)
+				buf = created.AppendFormat(buf, frac)
 			}
-		} else if len(piece) > 0 {
-			out.Write(piece)
+			buf = append(buf, texts[len(texts)-1]...)
+		case 'q':
+			buf = appendPadded(buf, created.Nanosecond()/1e6, 3)
+		case 'u':
+			buf = appendPadded(buf, created.Nanosecond()/1e3, 6)
+		case 'N':
+			buf = appendPadded(buf, created.Nanosecond(), 9)
+		case 'e':
+			buf = strconv.AppendInt(buf, created.Unix(), 10)
+		case 'E':
+			buf = strconv.AppendInt(buf, created.UnixNano()/1e6, 10)
+		case 'L':
+			buf = append(buf, rec.Level.String()...)
+		case 'l':
+			buf = append(buf, rec.Level.Name()...)
+		case 'S':
+			buf = append(buf, rec.Source...)
+		case 's':
+			buf = append(buf, rec.Source[strings.LastIndexByte(rec.Source, '/')+1:]...)
+		case 'F':
+			if len(rec.File) > 0 {
+				buf = append(buf, rec.File...)
+				buf = append(buf, ':')
+				buf = strconv.AppendInt(buf, int64(rec.Line), 10)
+			}
+		case 'f':
+			if len(rec.File) > 0 {
+				buf = append(buf, filepath.Base(rec.File)...)
+				buf = append(buf, ':')
+				buf = strconv.AppendInt(buf, int64(rec.Line), 10)
+			}
+		case 'P':
+			if len(rec.Func) > 0 {
+				buf = append(buf, funcPackage(rec.Func)...)
+			}
+		case 'M':
+			buf = append(buf, rec.Message...)
+		case 'c':
+			buf = append(buf, rec.Category...)
+		case 'I':
+			buf = append(buf, rec.TraceID...)
+		case 'i':
+			buf = append(buf, rec.SpanID...)
+		case 'K':
+			if len(rec.Stack) > 0 {
+				buf = append(buf, '\n')
+				buf = append(buf, strings.TrimRight(rec.Stack, "\n")...)
+			}
+		case 'X':
+			if len(part.text) > 0 {
+				if fld, ok := rec.Fields.lookup(part.text); ok {
+					buf = fld.appendText(buf)
+				}
+				break
+			}
+			for j, fld := range rec.Fields {
+				if j > 0 {
+					buf = append(buf, ' ')
+				}
+				buf = append(buf, fld.Key...)
+				buf = append(buf, '=')
+				buf = fld.appendText(buf)
+			}
+		}
+		if part.width > 0 || part.precision > 0 {
+			buf = part.align(buf, start)
+		}
+		if colored {
+			buf = append(buf, colorReset...)
 		}
 	}
-	out.WriteByte('\n')
+	return buf
+}
 
-	return out.String()
+// Truncate buf[start:], the text of the part, to its precision and pad it to
+// its width, counting characters rather than bytes
+func (part *formatPart) align(buf []byte, start int) []byte {
+	n := utf8.RuneCount(buf[start:])
+	if part.precision > 0 && n > part.precision {
+		if part.keepHead {
+			buf = buf[:start+runeOffset(buf[start:], part.precision)]
+		} else {
+			buf = append(buf[:start], buf[start+runeOffset(buf[start:], n-part.precision):]...)
+		}
+		n = part.precision
+	}
+	pad := part.width - n
+	if pad <= 0 {
+		return buf
+	}
+	for j := 0; j < pad; j++ {
+		buf = append(buf, ' ')
+	}
+	if !part.leftAlign {
+		copy(buf[start+pad:], buf[start:len(buf)-pad])
+		for j := start; j < start+pad; j++ {
+			buf[j] = ' '
+		}
+	}
+	return buf
+}
+
+// Return the offset in text of the character after the first n
+func runeOffset(text []byte, n int) int {
+	i := 0
+	for ; n > 0 && i < len(text); n-- {
+		_, size := utf8.DecodeRune(text[i:])
+		i += size
+	}
+	return i
+}
+
+// Return the layouts of the formatter formatted for the second t is in,
+// formatting them once per second
+func (f *PatternFormatter) timesOf(t time.Time) *timeCache {
+	secs := t.Unix()
+	if times := f.times.Load(); times != nil && times.secs == secs {
+		return times
+	}
+
+	times := &timeCache{secs: secs, texts: make([][]string, len(f.layouts))}
+	for i, l := range f.layouts {
+		texts := make([]string, len(l.rest))
+		for k, rest := range l.rest {
+			texts[k] = t.Format(rest)
+		}
+		times.texts[i] = texts
+	}
+	f.times.Store(times)
+	return times
+}
+
+// Append n, padded with zeros to width digits
+func appendPadded(buf []byte, n, width int) []byte {
+	var digits [9]byte
+	for i := width - 1; i >= 0; i-- {
+		digits[i] = byte('0' + n%10)
+		n /= 10
+	}
+	return append(buf, digits[:width]...)
+}
+
+// The formats compiled for FormatLogRecord, up to maxFormatters of them
+const maxFormatters = 256
+
+var (
+	formattersMu sync.RWMutex
+	formatters   = make(map[string]*PatternFormatter)
+)
+
+func lookupFormatter(format string) *PatternFormatter {
+	formattersMu.RLock()
+	f, ok := formatters[format]
+	formattersMu.RUnlock()
+	if ok {
+		return f
+	}
+
+	f, _ = compileFormat(format, false)
+	formattersMu.Lock()
+	if len(formatters) < maxFormatters {
+		formatters[format] = f
+	}
+	formattersMu.Unlock()
+	return f
 }
 
-// This is the standard writer that prints to standard output.
-type FormatLogWriter chan *LogRecord
+// Compile the format of a writer.  An invalid format is reported to the error
+// handler of the writer, and compiled ignoring what is wrong with it, as
+// FormatLogRecord does.
+func compileWriterFormat(q *recordQueue, writer, format string) *PatternFormatter {
+	f, err := CompileFormat(format)
+	if err != nil {
+		q.fail(&WriterError{Writer: writer, Op: "format", Err: err})
+		f, _ = compileFormat(format, false)
+	}
+	return f
+}
+
+// This is the standard writer that prints to standard output.  What it does
+// when its queue is full is set with SetOverflow.
+type FormatLogWriter struct {
+	*recordQueue
+	formatter atomicValue[Formatter]
+}
 
-// This creates a new FormatLogWriter
-func NewFormatLogWriter(out io.Writer, format string) FormatLogWriter {
-	records := make(FormatLogWriter, LogBufferLength)
-	go records.run(out, format)
-	return records
+// This creates a new FormatLogWriter.  An invalid format is reported to
+// DefaultErrorHandler (see CompileFormat).
+func NewFormatLogWriter(out io.Writer, format string) *FormatLogWriter {
+	w := &FormatLogWriter{recordQueue: newRecordQueue(LogBufferLength)}
+	w.SetFormatter(compileWriterFormat(w.recordQueue, "FormatLogWriter", format))
+	go w.run(out)
+	return w
 }
 
-func (w FormatLogWriter) run(out io.Writer, format string) {
-	for rec := range w {
-		fmt.Fprint(out, FormatLogRecord(format, rec))
+// SetFormatter changes how the records are written.  It is safe to call while
+// messages are being logged.
+func (w *FormatLogWriter) SetFormatter(f Formatter) {
+	w.formatter.Store(f)
+}
+
+func (w *FormatLogWriter) run(out io.Writer) {
+	defer w.exit(nil)
+	var buf []byte
+	for rec := range w.ch {
+		buf = w.formatter.Load().Format(rec, buf[:0])
+		if _, err := out.Write(buf); err != nil {
+			w.fail(&WriterError{Writer: "FormatLogWriter", Op: "write", Err: err})
+		}
+		w.wrote(rec)
 	}
 }
 
-// This is the FormatLogWriter's output method.  This will block if the output
-// buffer is full.
-func (w FormatLogWriter) LogWrite(rec *LogRecord) {
-	w <- rec
+// This is the FormatLogWriter's output method.  By default, this will block if
+// the output buffer is full.
+func (w *FormatLogWriter) LogWrite(rec *LogRecord) {
+	w.put(rec)
 }
 
-// Close stops the logger from sending messages to standard output.  Attempts to
-// send log messages to this logger after a Close have undefined behavior.
-func (w FormatLogWriter) Close() {
-	close(w)
+// Close stops the logger from sending messages to its output, once it has
+// written those queued (see CloseContext).  Attempts to send log messages to
+// this logger after a Close have undefined behavior.
+func (w *FormatLogWriter) Close() {
+	w.CloseContext(context.Background())
 }
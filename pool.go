@@ -0,0 +1,125 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Records made by a Logger come from recordPool and go back to it once every
+// writer they were given to is done with them.  Only the writers of this
+// package say when they are done with a record (see recordReleaser); a record
+// given to any other writer, which may keep it, is left to the garbage
+// collector instead.
+var recordPool = sync.Pool{
+	New: func() interface{} { return new(LogRecord) },
+}
+
+// A recordReleaser is a LogWriter which calls release on every record given to
+// it once it no longer uses the record.
+type recordReleaser interface {
+	releasesRecords()
+}
+
+// Get a record from the pool, holding one reference to it
+func getRecord() *LogRecord {
+	rec := recordPool.Get().(*LogRecord)
+	rec.refs = 1
+	rec.pooled = true
+	return rec
+}
+
+// Add n references to a pooled record
+func (rec *LogRecord) retain(n int32) {
+	atomic.AddInt32(&rec.refs, n)
+}
+
+// Drop a reference to rec, and put it back in the pool once there are none
+// left.  Does nothing for records which did not come from the pool.
+func (rec *LogRecord) release() {
+	if rec == nil || !rec.pooled {
+		return
+	}
+	if atomic.AddInt32(&rec.refs, -1) == 0 {
+		*rec = LogRecord{}
+		recordPool.Put(rec)
+	}
+}
+
+// Buffers for formatting records outside of the goroutines of writers, which
+// have their own
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 256)
+		return &buf
+	},
+}
+
+// Buffers which grew larger than this are not kept
+const maxPooledBuffer = 64 << 10
+
+func getBuffer() *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	*buf = (*buf)[:0]
+	return buf
+}
+
+func putBuffer(buf *[]byte) {
+	if cap(*buf) <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+// What is known about a call site, by program counter, so that it is looked up
+// and its source ("function:line") formatted once per call site
+type callSite struct {
+	pc      uintptr // as returned by runtime.Caller
+	fn, src string
+	file    string
+	line    int
+}
+
+// The cache stops growing at this size
+const maxCallSites = 1 << 14
+
+var (
+	callSitesMu sync.RWMutex
+	callSites   = make(map[uintptr]callSite)
+)
+
+// Return the call site skip frames above the caller of lookupCaller, as
+// runtime.Caller(skip) would, but without allocating once the call site has
+// been seen.  The zero callSite means it is unknown.
+func lookupCaller(skip int) callSite {
+	var pcs [1]uintptr
+	if runtime.Callers(skip+2, pcs[:]) == 0 {
+		return callSite{}
+	}
+	callSitesMu.RLock()
+	site, ok := callSites[pcs[0]]
+	callSitesMu.RUnlock()
+	if ok {
+		return site
+	}
+
+	frame, _ := runtime.CallersFrames([]uintptr{pcs[0]}).Next()
+	if frame.PC == 0 {
+		return callSite{}
+	}
+	site = callSite{
+		pc:   frame.PC,
+		fn:   frame.Function,
+		src:  frame.Function + ":" + strconv.Itoa(frame.Line),
+		file: frame.File,
+		line: frame.Line,
+	}
+	callSitesMu.Lock()
+	if len(callSites) < maxCallSites {
+		callSites[pcs[0]] = site
+	}
+	callSitesMu.Unlock()
+	return site
+}
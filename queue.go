@@ -0,0 +1,246 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what a writer does with a record when its queue of
+// LogBufferLength records is full.
+type OverflowPolicy int
+
+const (
+	// Wait until there is room in the queue (the default).
+	Block OverflowPolicy = iota
+
+	// Wait up to Overflow.Timeout, then drop the record.
+	BlockTimeout
+
+	// Drop the record.
+	DropNewest
+
+	// Drop the oldest queued record to make room.
+	DropOldest
+
+	// Drop records below Overflow.Level, and wait for room for the others.
+	DropBelowLevel
+)
+
+var overflowPolicyNames = [...]string{"block", "block-timeout", "drop-newest", "drop-oldest", "drop-below-level"}
+
+func (p OverflowPolicy) String() string {
+	if p >= 0 && int(p) < len(overflowPolicyNames) {
+		return overflowPolicyNames[p]
+	}
+	return "unknown"
+}
+
+// Overflow configures what a writer does when its queue is full (see the
+// SetOverflow methods of the writers).
+type Overflow struct {
+	Policy  OverflowPolicy
+	Timeout time.Duration // For BlockTimeout; without one it drops at once
+	Level   Level         // For DropBelowLevel
+
+	// If set, once there is room in the queue again, a WARNING record from the
+	// source "log4go" reports how many records were dropped.
+	ReportLoss bool
+}
+
+// A recordQueue is the queue between the log calls and the goroutine of a
+// writer, which applies the overflow policy of the writer and counts the
+// records it drops.  It also counts the records queued and those the goroutine
+// is done with (see wrote), so that Flush can wait for the latter to catch up.
+type recordQueue struct {
+	dropped    uint64 // accessed atomically
+	unreported uint64 // dropped since the last loss record; accessed atomically
+	queued     uint64 // accessed atomically
+	processed  uint64 // accessed atomically
+
+	ch       chan *LogRecord
+	overflow atomicValue[Overflow]
+
+	waiting  int32      // the number of calls to Flush; accessed atomically
+	mu       sync.Mutex // guards progress
+	progress chan struct{}
+
+	handler atomicValue[ErrorHandler] // see SetErrorHandler
+
+	closing  sync.Once
+	done     chan struct{} // closed when the writer goroutine exits
+	closeErr error         // set before done is closed
+}
+
+func newRecordQueue(size int) *recordQueue {
+	return &recordQueue{ch: make(chan *LogRecord, size), done: make(chan struct{})}
+}
+
+// SetOverflow changes what the writer does with records when its queue is
+// full.  It is safe to call while messages are being logged.
+func (q *recordQueue) SetOverflow(overflow Overflow) {
+	q.overflow.Store(overflow)
+}
+
+// Dropped returns the number of records the writer has dropped because its
+// queue was full.
+func (q *recordQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// Queue rec for the writer goroutine according to the overflow policy.  The
+// record is counted as queued up front, and as processed if it is dropped, so
+// that Flush never waits for a record which will not be written.
+func (q *recordQueue) put(rec *LogRecord) {
+	overflow := q.overflow.Load()
+	if overflow.ReportLoss && atomic.LoadUint64(&q.unreported) > 0 {
+		q.reportLoss()
+	}
+	atomic.AddUint64(&q.queued, 1)
+
+	switch overflow.Policy {
+	case Block:
+		q.ch <- rec
+		return
+	case DropBelowLevel:
+		if rec.Level >= overflow.Level {
+			q.ch <- rec
+			return
+		}
+	}
+
+	select {
+	case q.ch <- rec:
+		return
+	default:
+	}
+
+	switch overflow.Policy {
+	case BlockTimeout:
+		if overflow.Timeout > 0 {
+			timer := time.NewTimer(overflow.Timeout)
+			defer timer.Stop()
+			select {
+			case q.ch <- rec:
+				return
+			case <-timer.C:
+			}
+		}
+	case DropOldest:
+		// Other log calls compete for the room, so only try so often
+		for i := 0; i <= cap(q.ch); i++ {
+			select {
+			case old := <-q.ch:
+				q.drop(old)
+			default:
+			}
+			select {
+			case q.ch <- rec:
+				return
+			default:
+			}
+		}
+	}
+	q.drop(rec)
+}
+
+func (q *recordQueue) drop(rec *LogRecord) {
+	atomic.AddUint64(&q.dropped, 1)
+	atomic.AddUint64(&q.unreported, 1)
+	q.wrote(rec)
+}
+
+// Queue a record reporting the records dropped since the last one, if there is
+// room for it
+func (q *recordQueue) reportLoss() {
+	n := atomic.SwapUint64(&q.unreported, 0)
+	if n == 0 {
+		return
+	}
+	rec := &LogRecord{
+		Level:   WARNING,
+		Created: time.Now(),
+		Source:  "log4go",
+		Message: fmt.Sprintf("dropped %d records because the queue was full", n),
+		Fields:  Fields{Uint64("dropped", n)},
+	}
+	atomic.AddUint64(&q.queued, 1)
+	select {
+	case q.ch <- rec:
+	default:
+		atomic.AddUint64(&q.unreported, n)
+		q.wrote(rec)
+	}
+}
+
+// Called by the writer goroutine once it is done with a record, which may then
+// be reused
+func (q *recordQueue) wrote(rec *LogRecord) {
+	rec.release()
+	atomic.AddUint64(&q.processed, 1)
+	if atomic.LoadInt32(&q.waiting) > 0 {
+		q.mu.Lock()
+		if q.progress != nil {
+			close(q.progress)
+			q.progress = nil
+		}
+		q.mu.Unlock()
+	}
+}
+
+// The writers of this package release the records given to them
+func (q *recordQueue) releasesRecords() {}
+
+// Flush waits until the writer has written the records queued before the call,
+// or until ctx is done.
+func (q *recordQueue) Flush(ctx context.Context) error {
+	atomic.AddInt32(&q.waiting, 1)
+	defer atomic.AddInt32(&q.waiting, -1)
+
+	target := atomic.LoadUint64(&q.queued)
+	for {
+		q.mu.Lock()
+		if atomic.LoadUint64(&q.processed) >= target {
+			q.mu.Unlock()
+			return nil
+		}
+		if q.progress == nil {
+			q.progress = make(chan struct{})
+		}
+		progress := q.progress
+		q.mu.Unlock()
+
+		select {
+		case <-progress:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Called by the writer goroutine as it exits, with the error (if any) of
+// releasing what it writes to
+func (q *recordQueue) exit(err error) {
+	q.closeErr = err
+	close(q.done)
+}
+
+// CloseContext stops the writer and waits until it has written the records
+// queued and released what it writes to, or until ctx is done.  It returns the
+// error of releasing it, or the error of ctx.  Records must not be written to
+// the writer once it is closed; closing it again waits the same way.
+func (q *recordQueue) CloseContext(ctx context.Context) error {
+	q.closing.Do(func() {
+		close(q.ch)
+	})
+	select {
+	case <-q.done:
+		return q.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -3,53 +3,67 @@
 package log4go
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"net"
-	"os"
 )
 
-// This log writer sends output to a socket
-type SocketLogWriter chan *LogRecord
+// This log writer sends output to a socket, one record per write, formatted by
+// JSONFormatter unless SetFormatter says otherwise.  What it does when its
+// queue is full is set with SetOverflow.
+type SocketLogWriter struct {
+	*recordQueue
+	formatter atomicValue[Formatter]
+}
 
 // This is the SocketLogWriter's output method
-func (w SocketLogWriter) LogWrite(rec *LogRecord) {
-	w <- rec
+func (w *SocketLogWriter) LogWrite(rec *LogRecord) {
+	w.put(rec)
+}
+
+// SetFormatter changes how the records are sent.  It is safe to call while
+// messages are being logged.
+func (w *SocketLogWriter) SetFormatter(f Formatter) {
+	w.formatter.Store(f)
 }
 
-func (w SocketLogWriter) Close() {
-	close(w)
+// Close stops the writer, waiting until it has sent the records queued and
+// closed the socket.  See CloseContext.
+func (w *SocketLogWriter) Close() {
+	w.CloseContext(context.Background())
 }
 
-func NewSocketLogWriter(proto, hostport string) SocketLogWriter {
+// NewSocketLogWriter creates a SocketLogWriter sending records to hostport.
+// If it cannot connect, it passes the error to DefaultErrorHandler and returns
+// nil, which AddFilter ignores; the writer is a LogWriter rather than a
+// *SocketLogWriter so that the nil stays nil.
+func NewSocketLogWriter(proto, hostport string) LogWriter {
 	sock, err := net.Dial(proto, hostport)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewSocketLogWriter(%q): %s\n", hostport, err)
+		DefaultErrorHandler(&WriterError{Writer: fmt.Sprintf("SocketLogWriter(%q)", hostport), Op: "dial", Err: err})
 		return nil
 	}
 
-	w := SocketLogWriter(make(chan *LogRecord, LogBufferLength))
+	w := &SocketLogWriter{recordQueue: newRecordQueue(LogBufferLength)}
+	w.SetFormatter(JSONFormatter{})
 
 	go func() {
+		name := fmt.Sprintf("SocketLogWriter(%q)", hostport)
 		defer func() {
-			if sock != nil && proto == "tcp" {
-				sock.Close()
-			}
-		}()
-
-		for rec := range w {
-			// Marshall into JSON
-			js, err := json.Marshal(rec)
+			err := sock.Close()
 			if err != nil {
-				fmt.Fprint(os.Stderr, "SocketLogWriter(%q): %s", hostport, err)
-				return
+				w.fail(&WriterError{Writer: name, Op: "close", Err: err})
 			}
+			w.exit(err)
+		}()
 
-			_, err = sock.Write(js)
-			if err != nil {
-				fmt.Fprint(os.Stderr, "SocketLogWriter(%q): %s", hostport, err)
-				return
+		var buf []byte
+		for rec := range w.ch {
+			buf = w.formatter.Load().Format(rec, buf[:0])
+			if _, err := sock.Write(buf); err != nil {
+				w.fail(&WriterError{Writer: name, Op: "write", Err: err})
 			}
+			w.wrote(rec)
 		}
 	}()
 
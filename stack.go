@@ -0,0 +1,113 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// DefaultStackDepth is the number of frames captured when StackTrace.Depth is
+// not set.
+const DefaultStackDepth = 32
+
+// StackTrace configures the capture of stack traces into LogRecord.Stack (see
+// SetStackTrace).
+type StackTrace struct {
+	// Records at or above Level carry the stack of the logging goroutine.  A
+	// level above CRITICAL disables capture.
+	Level Level
+
+	// The maximum number of frames captured; zero means DefaultStackDepth.
+	Depth int
+
+	// If set, CRITICAL records carry the stacks of all goroutines instead.
+	AllGoroutines bool
+}
+
+// The package path, used to leave the logging machinery out of stack traces
+var packagePath = reflect.TypeOf(Logger{}).PkgPath()
+
+// SetStackTrace makes records logged through log at or above st.Level carry a
+// stack trace, beginning at the function which logged the message.  Frames of
+// the runtime and of log4go itself are left out.  The stack is printed by the
+// %K format verb and by the XML and JSON writers.
+//
+// Named loggers with no settings of their own use those of their nearest
+// ancestor; a nil st restores that (and disables capture on a root logger).
+func (log *Logger) SetStackTrace(st *StackTrace) {
+	if st != nil {
+		copy := *st
+		st = &copy
+	}
+
+	hier := log.cat.hier
+	hier.mu.Lock()
+	defer hier.mu.Unlock()
+	log.cat.stack = st
+	hier.updateLevels()
+}
+
+// Return the stack trace for a record at lvl logged from skip frames above the
+// caller of stackFor, or "" if none is wanted
+func (log *Logger) stackFor(lvl Level, skip int) string {
+	st := log.cat.effStack.Load()
+	if st == nil || lvl < st.Level {
+		return ""
+	}
+	if st.AllGoroutines && lvl >= CRITICAL {
+		return allGoroutines()
+	}
+	depth := st.Depth
+	if depth <= 0 {
+		depth = DefaultStackDepth
+	}
+	return captureStack(skip+1, depth)
+}
+
+// Format up to depth frames of the current stack, starting skip frames above
+// the caller of captureStack, leaving out the runtime and this package (but
+// not its tests).
+func captureStack(skip, depth int) string {
+	pcs := make([]uintptr, depth)
+	pcs = pcs[:runtime.Callers(skip+2, pcs)]
+
+	out := bytes.NewBuffer(make([]byte, 0, 128*len(pcs)))
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		if len(frame.Function) > 0 && !hiddenFrame(frame) {
+			fmt.Fprintf(out, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		}
+		if !more {
+			break
+		}
+	}
+	return out.String()
+}
+
+// Report whether the frame belongs to the runtime or to the logging machinery
+func hiddenFrame(frame runtime.Frame) bool {
+	switch pkg := funcPackage(frame.Function); {
+	case pkg == "runtime" || strings.HasPrefix(pkg, "runtime/"):
+		return true
+	case pkg == packagePath:
+		return !strings.HasSuffix(frame.File, "_test.go")
+	}
+	return false
+}
+
+// Return the stacks of all goroutines, as printed by the runtime
+func allGoroutines() string {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -3,47 +3,169 @@
 package log4go
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"os"
-	"time"
+	"sync"
 )
 
-var stdout io.Writer = os.Stdout
+var (
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+// A ConsoleTarget is where a ConsoleLogWriter writes records.
+type ConsoleTarget int
+
+const (
+	ConsoleStdout ConsoleTarget = iota // Standard output (the default)
+	ConsoleStderr                      // Standard error
+	ConsoleSplit                       // Standard output below ConsoleOptions.SplitLevel, standard error from it up
+)
+
+var consoleTargetNames = [...]string{"stdout", "stderr", "split"}
+
+func (t ConsoleTarget) String() string {
+	if t >= 0 && int(t) < len(consoleTargetNames) {
+		return consoleTargetNames[t]
+	}
+	return "unknown"
+}
 
-// This is the standard writer that prints to standard output.
+// ConsoleOptions configures a ConsoleLogWriter (see NewConsoleLogWriterWith).
+type ConsoleOptions struct {
+	Target ConsoleTarget
+
+	// The lowest level ConsoleSplit writes to standard error, if
+	// SplitLevelSet is true; otherwise WARNING.
+	SplitLevel    Level
+	SplitLevelSet bool
+
+	// Sync writes records in the goroutine which logs them, before the log
+	// call returns, so that they are in order with what the program prints
+	// itself.  Otherwise they are queued for the goroutine of the writer.
+	Sync bool
+}
+
+// This is the standard writer that prints to standard output, or standard
+// error (see ConsoleOptions).  What it does when its queue is full is set with
+// SetOverflow, and whether it colors the records with SetColors.
 type ConsoleLogWriter struct {
-	format string
-	w      chan *LogRecord
+	*recordQueue
+	out       io.Writer
+	errOut    io.Writer // nil unless records from split up go to it
+	split     Level
+	formatter atomicValue[Formatter]
+	painter   atomicValue[*painter] // nil unless the records are colored
+
+	// In sync mode, records are written under mu, without the queue
+	sync bool
+	mu   sync.Mutex
+	buf  []byte
 }
 
 // This creates a new ConsoleLogWriter
 func NewConsoleLogWriter() *ConsoleLogWriter {
-	consoleWriter := &ConsoleLogWriter{
-		format: "[%T %D] [%L] (%S) %M",
-		w:      make(chan *LogRecord, LogBufferLength),
+	return NewConsoleLogWriterWith(ConsoleOptions{})
+}
+
+// NewConsoleLogWriterWith creates a new ConsoleLogWriter with the given options.
+func NewConsoleLogWriterWith(opts ConsoleOptions) *ConsoleLogWriter {
+	consoleWriter := &ConsoleLogWriter{recordQueue: newRecordQueue(LogBufferLength), out: stdout, sync: opts.Sync}
+	switch opts.Target {
+	case ConsoleStderr:
+		consoleWriter.out = stderr
+	case ConsoleSplit:
+		consoleWriter.errOut, consoleWriter.split = stderr, WARNING
+		if opts.SplitLevelSet {
+			consoleWriter.split = opts.SplitLevel
+		}
+	}
+	consoleWriter.SetFormat("[%T %D] [%L] (%S) %M")
+	if consoleWriter.sync {
+		// There is no goroutine for Close to wait for
+		consoleWriter.exit(nil)
+	} else {
+		go consoleWriter.run()
 	}
-	go consoleWriter.run(stdout)
 	return consoleWriter
 }
+
+// SetFormat changes the format of the records written (see FormatLogRecord).
+// An invalid format is reported to the error handler of the writer.  It is
+// safe to call while messages are being logged.
 func (c *ConsoleLogWriter) SetFormat(format string) {
-	c.format = format
+	c.SetFormatter(compileWriterFormat(c.recordQueue, "ConsoleLogWriter", format))
+}
+
+// SetFormatter changes how the records are written.  It is safe to call while
+// messages are being logged.
+func (c *ConsoleLogWriter) SetFormatter(f Formatter) {
+	c.formatter.Store(f)
+}
+
+// SetColors sets whether and how the writer colors the records it writes with
+// ANSI escape sequences; they are not colored unless it is called.  With
+// ColorAuto, whether the output is a terminal and NO_COLOR is set are checked
+// when SetColors is called.  It is safe to call while messages are being
+// logged.
+func (c *ConsoleLogWriter) SetColors(colors Colors) {
+	p := newPainter(colors, c.out)
+	if p != nil && c.errOut != nil && colors.Mode == ColorAuto && !isTerminal(c.errOut) {
+		p = nil
+	}
+	c.painter.Store(p)
 }
-func (c *ConsoleLogWriter) run(out io.Writer) {
-	for rec := range c.w {
-		fmt.Fprint(out, FormatLogRecord(c.format, rec))
+
+// Format rec for the console, in color if it has any
+func (c *ConsoleLogWriter) format(rec *LogRecord, buf []byte) []byte {
+	f := c.formatter.Load()
+	if p := c.painter.Load(); p != nil {
+		if pf, ok := f.(*PatternFormatter); ok {
+			return pf.formatColored(rec, buf, p)
+		}
 	}
+	return f.Format(rec, buf)
 }
 
-// This is the ConsoleLogWriter's output method.  This will block if the output
-// buffer is full.
+// Write buf, the formatted rec, to the output for its level
+func (c *ConsoleLogWriter) write(rec *LogRecord, buf []byte) {
+	out := c.out
+	if c.errOut != nil && rec.Level >= c.split {
+		out = c.errOut
+	}
+	if _, err := out.Write(buf); err != nil {
+		c.fail(&WriterError{Writer: "ConsoleLogWriter", Op: "write", Err: err})
+	}
+}
+
+func (c *ConsoleLogWriter) run() {
+	defer c.exit(nil)
+	var buf []byte
+	for rec := range c.ch {
+		buf = c.format(rec, buf[:0])
+		c.write(rec, buf)
+		c.wrote(rec)
+	}
+}
+
+// This is the ConsoleLogWriter's output method.  By default, this will block if
+// the output buffer is full; in sync mode, it writes rec before returning.
 func (c *ConsoleLogWriter) LogWrite(rec *LogRecord) {
-	c.w <- rec
+	if c.sync {
+		c.mu.Lock()
+		c.buf = c.format(rec, c.buf[:0])
+		c.write(rec, c.buf)
+		c.mu.Unlock()
+		rec.release()
+		return
+	}
+	c.put(rec)
 }
 
-// Close stops the logger from sending messages to standard output.  Attempts to
-// send log messages to this logger after a Close have undefined behavior.
+// Close stops the logger from sending messages to standard output, once it has
+// written those queued (see CloseContext).  Attempts to send log messages to
+// this logger after a Close have undefined behavior.
 func (c *ConsoleLogWriter) Close() {
-	close(c.w)
-	time.Sleep(50 * time.Millisecond) // Try to give console I/O time to complete
+	c.CloseContext(context.Background())
 }
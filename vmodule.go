@@ -0,0 +1,189 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// VModuleEnv is the environment variable holding the initial per-source level
+// overrides of every logger (see SetVModule).
+const VModuleEnv = "LOG4GO_VMODULE"
+
+// A vmodule is a parsed set of per-source level overrides.  It is immutable
+// once built, apart from its cache, and replaced as a whole when the rules
+// change.
+type vmodule struct {
+	rules []vmoduleRule
+	min   Level
+
+	cache sync.Map // program counter -> Level, or noOverride
+}
+
+type vmoduleRule struct {
+	pattern string
+	level   Level
+	name    string // the level as written in the spec
+}
+
+// Cached for program counters which match no rule
+const noOverride = Level(noLevel)
+
+// Parse a comma-separated list of pattern=LEVEL rules
+func parseVModule(spec string) (*vmodule, error) {
+	vm := &vmodule{min: noOverride}
+	for _, rule := range strings.Split(spec, ",") {
+		if rule = strings.TrimSpace(rule); len(rule) == 0 {
+			continue
+		}
+		eq := strings.LastIndexByte(rule, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("log4go: vmodule rule %q is not of the form pattern=LEVEL", rule)
+		}
+		pattern, name := strings.TrimSpace(rule[:eq]), strings.TrimSpace(rule[eq+1:])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("log4go: vmodule rule %q: %s", rule, err)
+		}
+		lvl, err := ParseLevel(name)
+		if err != nil {
+			return nil, fmt.Errorf("log4go: vmodule rule %q has unknown level %q", rule, name)
+		}
+		vm.rules = append(vm.rules, vmoduleRule{pattern, lvl, name})
+		if lvl < vm.min {
+			vm.min = lvl
+		}
+	}
+	return vm, nil
+}
+
+// Return the level overriding the filters for the code at pc, if any.  The
+// first matching rule wins.
+func (vm *vmodule) levelFor(pc uintptr) (Level, bool) {
+	if lvl, ok := vm.cache.Load(pc); ok {
+		return lvl.(Level), lvl.(Level) != noOverride
+	}
+
+	lvl := noOverride
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		file, _ := fn.FileLine(pc)
+		pkg := funcPackage(fn.Name())
+		file = strings.TrimSuffix(file, ".go")
+		for _, rule := range vm.rules {
+			if matchPathSuffix(rule.pattern, pkg) || matchPathSuffix(rule.pattern, file) {
+				lvl = rule.level
+				break
+			}
+		}
+	}
+	vm.cache.Store(pc, lvl)
+	return lvl, lvl != noOverride
+}
+
+func (vm *vmodule) String() string {
+	rules := make([]string, len(vm.rules))
+	for i, rule := range vm.rules {
+		rules[i] = rule.pattern + "=" + rule.name
+	}
+	return strings.Join(rules, ",")
+}
+
+// Report whether pattern matches name or any part of it following a slash, so
+// that "storage" and "mypkg/storage" both match "example.com/mypkg/storage".
+func matchPathSuffix(pattern, name string) bool {
+	for {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		slash := strings.IndexByte(name, '/')
+		if slash < 0 {
+			return false
+		}
+		name = name[slash+1:]
+	}
+}
+
+// Return the import path of the package of the named function
+func funcPackage(fn string) string {
+	slash := strings.LastIndexByte(fn, '/')
+	if dot := strings.IndexByte(fn[slash+1:], '.'); dot >= 0 {
+		return fn[:slash+1+dot]
+	}
+	return fn
+}
+
+var (
+	envVModuleOnce sync.Once
+	envVModule     *vmodule
+	envVModuleErr  error
+)
+
+// VModuleEnvError returns the error in the rules of the LOG4GO_VMODULE
+// environment variable, which are ignored if they are invalid, or nil.
+func VModuleEnvError() error {
+	vmoduleFromEnv()
+	return envVModuleErr
+}
+
+// Return the rules from the environment, which are parsed only once
+func vmoduleFromEnv() *vmodule {
+	envVModuleOnce.Do(func() {
+		spec := os.Getenv(VModuleEnv)
+		if len(spec) == 0 {
+			return
+		}
+		vm, err := parseVModule(spec)
+		if err != nil {
+			envVModuleErr = fmt.Errorf("%s: %w", VModuleEnv, err)
+			return
+		}
+		envVModule = vm
+	})
+	return envVModule
+}
+
+// SetVModule overrides the level of messages based on the package or file of
+// the code logging them.  The spec is a comma-separated list of rules such as
+//
+//	mypkg/storage=FINEST,net/*=WARNING
+//
+// where each pattern (in the syntax of path.Match) is matched against the
+// import path of the calling package and against the path of its source file
+// without the .go extension, and also against every part of them following a
+// slash.  The first rule which matches wins, and messages from matching code
+// are written to every filter of the logger if they are at or above the level
+// of the rule, regardless of the levels of the filters, and dropped otherwise.
+// Calls to Log, which are given their source, are not affected.
+//
+// The rules apply to the whole hierarchy of the logger; an empty spec removes
+// them.  The initial rules are taken from the LOG4GO_VMODULE environment
+// variable (see VModuleEnvError).
+func (log *Logger) SetVModule(spec string) error {
+	vm, err := parseVModule(spec)
+	if err != nil {
+		return err
+	}
+	if len(vm.rules) == 0 {
+		vm = nil
+	}
+
+	hier := log.cat.hier
+	hier.mu.Lock()
+	defer hier.mu.Unlock()
+	hier.vmodule.Store(vm)
+	hier.updateLevels()
+	return nil
+}
+
+// VModule returns the per-source level overrides of the logger in the form
+// accepted by SetVModule.
+func (log *Logger) VModule() string {
+	if vm := log.cat.hier.vmodule.Load(); vm != nil {
+		return vm.String()
+	}
+	return ""
+}
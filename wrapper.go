@@ -3,14 +3,14 @@
 package log4go
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"os"
 	"strings"
 )
 
 var (
-	Global Logger
+	Global *Logger
 )
 
 func init() {
@@ -27,6 +27,59 @@ func AddFilter(name string, lvl Level, writer LogWriter) {
 	Global.AddFilter(name, lvl, writer)
 }
 
+// Wrapper for (*Logger).GetLogger
+func GetLogger(name string) *Logger {
+	return Global.GetLogger(name)
+}
+
+// Wrapper for (*Logger).SetLevel
+func SetLevel(name string, lvl Level) bool {
+	return Global.SetLevel(name, lvl)
+}
+
+// Wrapper for (*Logger).SetThreshold
+func SetThreshold(lvl Level) {
+	Global.SetThreshold(lvl)
+}
+
+// Wrapper for (*Logger).SetVModule
+func SetVModule(spec string) error {
+	return Global.SetVModule(spec)
+}
+
+// Wrapper for (*Logger).SetErrorHandler
+func SetErrorHandler(h ErrorHandler) {
+	Global.SetErrorHandler(h)
+}
+
+// Wrapper for (*Logger).CloseContext
+func CloseContext(ctx context.Context) error {
+	return Global.CloseContext(ctx)
+}
+
+// Wrapper for (*Logger).Flush
+func Flush(ctx context.Context) error {
+	return Global.Flush(ctx)
+}
+
+// Wrapper for (*Logger).SetStackTrace
+func SetStackTrace(st *StackTrace) {
+	Global.SetStackTrace(st)
+}
+
+// Wrapper for (*Logger).With
+func With(fields ...Field) *Logger {
+	return Global.With(fields...)
+}
+
+// Make the package-level logging functions skip n more stack frames when
+// determining the source of a message (see (*Logger).WithCallerSkip), for
+// functions which wrap them.  Like LoadConfiguration, this should be called
+// before logging starts.
+func SetCallerSkip(n int) {
+	Global = Global.WithCallerSkip(n - Global.skip)
+}
+
 // Wrapper for (*Logger).Close (closes and removes all logwriters)
 func Close() {
 	Global.Close()
@@ -34,14 +87,14 @@ func Close() {
 
 func Crash(args ...interface{}) {
 	if len(args) > 0 {
-		Global.intLogf(CRITICAL, strings.Repeat(" %v", len(args))[1:], args...)
+		Global.intLogf(nil, CRITICAL, strings.Repeat(" %v", len(args))[1:], args...)
 	}
 	panic(args)
 }
 
 // Logs the given message and crashes the program
 func Crashf(format string, args ...interface{}) {
-	Global.intLogf(CRITICAL, format, args...)
+	Global.intLogf(nil, CRITICAL, format, args...)
 	Global.Close() // so that hopefully the messages get logged
 	panic(fmt.Sprintf(format, args...))
 }
@@ -49,7 +102,7 @@ func Crashf(format string, args ...interface{}) {
 // Compatibility with `log`
 func Exit(args ...interface{}) {
 	if len(args) > 0 {
-		Global.intLogf(ERROR, strings.Repeat(" %v", len(args))[1:], args...)
+		Global.intLogf(nil, ERROR, strings.Repeat(" %v", len(args))[1:], args...)
 	}
 	Global.Close() // so that hopefully the messages get logged
 	os.Exit(0)
@@ -57,7 +110,7 @@ func Exit(args ...interface{}) {
 
 // Compatibility with `log`
 func Exitf(format string, args ...interface{}) {
-	Global.intLogf(ERROR, format, args...)
+	Global.intLogf(nil, ERROR, format, args...)
 	Global.Close() // so that hopefully the messages get logged
 	os.Exit(0)
 }
@@ -65,25 +118,25 @@ func Exitf(format string, args ...interface{}) {
 // Compatibility with `log`
 func Stderr(args ...interface{}) {
 	if len(args) > 0 {
-		Global.intLogf(ERROR, strings.Repeat(" %v", len(args))[1:], args...)
+		Global.intLogf(nil, ERROR, strings.Repeat(" %v", len(args))[1:], args...)
 	}
 }
 
 // Compatibility with `log`
 func Stderrf(format string, args ...interface{}) {
-	Global.intLogf(ERROR, format, args...)
+	Global.intLogf(nil, ERROR, format, args...)
 }
 
 // Compatibility with `log`
 func Stdout(args ...interface{}) {
 	if len(args) > 0 {
-		Global.intLogf(INFO, strings.Repeat(" %v", len(args))[1:], args...)
+		Global.intLogf(nil, INFO, strings.Repeat(" %v", len(args))[1:], args...)
 	}
 }
 
 // Compatibility with `log`
 func Stdoutf(format string, args ...interface{}) {
-	Global.intLogf(INFO, format, args...)
+	Global.intLogf(nil, INFO, format, args...)
 }
 
 // Send a log message manually
@@ -95,13 +148,19 @@ func Log(lvl Level, source, message string) {
 // Send a formatted log message easily
 // Wrapper for (*Logger).Logf
 func Logf(lvl Level, format string, args ...interface{}) {
-	Global.intLogf(lvl, format, args...)
+	Global.intLogf(nil, lvl, format, args...)
 }
 
 // Send a closure log message
 // Wrapper for (*Logger).Logc
 func Logc(lvl Level, closure func() string) {
-	Global.intLogc(lvl, closure)
+	Global.intLogc(nil, lvl, closure)
+}
+
+// Send a formatted log message carrying the fields and trace of ctx
+// Wrapper for (*Logger).LogCtx
+func LogCtx(ctx context.Context, lvl Level, format string, args ...interface{}) {
+	Global.intLogf(ctx, lvl, format, args...)
 }
 
 // Utility for finest log messages (see Debug() for parameter explanation)
@@ -113,13 +172,13 @@ func Finest(arg0 interface{}, args ...interface{}) {
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		Global.intLogf(lvl, first, args...)
+		Global.intLogf(nil, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		Global.intLogc(lvl, first)
+		Global.intLogc(nil, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		Global.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+		Global.intLogf(nil, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
 }
 
@@ -132,13 +191,13 @@ func Fine(arg0 interface{}, args ...interface{}) {
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		Global.intLogf(lvl, first, args...)
+		Global.intLogf(nil, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		Global.intLogc(lvl, first)
+		Global.intLogc(nil, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		Global.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+		Global.intLogf(nil, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
 }
 
@@ -154,13 +213,13 @@ func Debug(arg0 interface{}, args ...interface{}) {
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		Global.intLogf(lvl, first, args...)
+		Global.intLogf(nil, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		Global.intLogc(lvl, first)
+		Global.intLogc(nil, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		Global.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+		Global.intLogf(nil, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
 }
 
@@ -173,13 +232,13 @@ func Trace(arg0 interface{}, args ...interface{}) {
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		Global.intLogf(lvl, first, args...)
+		Global.intLogf(nil, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		Global.intLogc(lvl, first)
+		Global.intLogc(nil, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		Global.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+		Global.intLogf(nil, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
 }
 
@@ -192,13 +251,13 @@ func Info(arg0 interface{}, args ...interface{}) {
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		Global.intLogf(lvl, first, args...)
+		Global.intLogf(nil, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		Global.intLogc(lvl, first)
+		Global.intLogc(nil, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		Global.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+		Global.intLogf(nil, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
 }
 
@@ -209,70 +268,162 @@ func Warn(arg0 interface{}, args ...interface{}) error {
 	const (
 		lvl = WARNING
 	)
+	err := makeError(arg0, args)
+	Global.intLogf(nil, lvl, "%s", err.Error())
+	return err
+}
+
+// Utility for error log messages (returns an error for easy function returns) (see Debug() for parameter explanation)
+// These functions will execute a closure exactly once, to build the error message for the return
+// Wrapper for (*Logger).Error
+func Error(arg0 interface{}, args ...interface{}) error {
+	const (
+		lvl = ERROR
+	)
+	err := makeError(arg0, args)
+	Global.intLogf(nil, lvl, "%s", err.Error())
+	return err
+}
+
+// Utility for critical log messages (returns an error for easy function returns) (see Debug() for parameter explanation)
+// These functions will execute a closure exactly once, to build the error message for the return
+// Wrapper for (*Logger).Critical
+func Critical(arg0 interface{}, args ...interface{}) error {
+	const (
+		lvl = CRITICAL
+	)
+	err := makeError(arg0, args)
+	Global.intLogf(nil, lvl, "%s", err.Error())
+	return err
+}
+
+// Utility for finest log messages carrying the fields and trace of ctx (see Debug() for parameter explanation)
+// Wrapper for (*Logger).FinestCtx
+func FinestCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	const (
+		lvl = FINEST
+	)
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		Global.intLogf(lvl, first, args...)
-		return errors.New(fmt.Sprintf(first, args...))
+		Global.intLogf(ctx, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		str := first()
-		Global.intLogf(lvl, "%s", str)
-		return errors.New(str)
+		Global.intLogc(ctx, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		Global.intLogf(lvl, fmt.Sprint(first)+strings.Repeat(" %v", len(args)), args...)
-		return errors.New(fmt.Sprint(first) + fmt.Sprintf(strings.Repeat(" %v", len(args)), args...))
+		Global.intLogf(ctx, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
-	return nil
 }
 
-// Utility for error log messages (returns an error for easy function returns) (see Debug() for parameter explanation)
-// These functions will execute a closure exactly once, to build the error message for the return
-// Wrapper for (*Logger).Error
-func Error(arg0 interface{}, args ...interface{}) error {
+// Utility for fine log messages carrying the fields and trace of ctx (see Debug() for parameter explanation)
+// Wrapper for (*Logger).FineCtx
+func FineCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
 	const (
-		lvl = ERROR
+		lvl = FINE
 	)
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		Global.intLogf(lvl, first, args...)
-		return errors.New(fmt.Sprintf(first, args...))
+		Global.intLogf(ctx, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		str := first()
-		Global.intLogf(lvl, "%s", str)
-		return errors.New(str)
+		Global.intLogc(ctx, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		Global.intLogf(lvl, fmt.Sprint(first)+strings.Repeat(" %v", len(args)), args...)
-		return errors.New(fmt.Sprint(first) + fmt.Sprintf(strings.Repeat(" %v", len(args)), args...))
+		Global.intLogf(ctx, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
-	return nil
 }
 
-// Utility for critical log messages (returns an error for easy function returns) (see Debug() for parameter explanation)
-// These functions will execute a closure exactly once, to build the error message for the return
-// Wrapper for (*Logger).Critical
-func Critical(arg0 interface{}, args ...interface{}) error {
+// Utility for debug log messages carrying the fields and trace of ctx (see Debug() for parameter explanation)
+// Wrapper for (*Logger).DebugCtx
+func DebugCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
 	const (
-		lvl = CRITICAL
+		lvl = DEBUG
+	)
+	switch first := arg0.(type) {
+	case string:
+		// Use the string as a format string
+		Global.intLogf(ctx, lvl, first, args...)
+	case func() string:
+		// Log the closure (no other arguments used)
+		Global.intLogc(ctx, lvl, first)
+	default:
+		// Build a format string so that it will be similar to Sprint
+		Global.intLogf(ctx, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+	}
+}
+
+// Utility for trace log messages carrying the fields and trace of ctx (see Debug() for parameter explanation)
+// Wrapper for (*Logger).TraceCtx
+func TraceCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	const (
+		lvl = TRACE
+	)
+	switch first := arg0.(type) {
+	case string:
+		// Use the string as a format string
+		Global.intLogf(ctx, lvl, first, args...)
+	case func() string:
+		// Log the closure (no other arguments used)
+		Global.intLogc(ctx, lvl, first)
+	default:
+		// Build a format string so that it will be similar to Sprint
+		Global.intLogf(ctx, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+	}
+}
+
+// Utility for info log messages carrying the fields and trace of ctx (see Debug() for parameter explanation)
+// Wrapper for (*Logger).InfoCtx
+func InfoCtx(ctx context.Context, arg0 interface{}, args ...interface{}) {
+	const (
+		lvl = INFO
 	)
 	switch first := arg0.(type) {
 	case string:
 		// Use the string as a format string
-		Global.intLogf(lvl, first, args...)
-		return errors.New(fmt.Sprintf(first, args...))
+		Global.intLogf(ctx, lvl, first, args...)
 	case func() string:
 		// Log the closure (no other arguments used)
-		str := first()
-		Global.intLogf(lvl, "%s", str)
-		return errors.New(str)
+		Global.intLogc(ctx, lvl, first)
 	default:
 		// Build a format string so that it will be similar to Sprint
-		Global.intLogf(lvl, fmt.Sprint(first)+strings.Repeat(" %v", len(args)), args...)
-		return errors.New(fmt.Sprint(first) + fmt.Sprintf(strings.Repeat(" %v", len(args)), args...))
+		Global.intLogf(ctx, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
 	}
-	return nil
+}
+
+// Utility for warn log messages carrying the fields and trace of ctx (returns an error for easy function returns) (see Debug() for parameter explanation)
+// These functions will execute a closure exactly once, to build the error message for the return
+// Wrapper for (*Logger).WarnCtx
+func WarnCtx(ctx context.Context, arg0 interface{}, args ...interface{}) error {
+	const (
+		lvl = WARNING
+	)
+	err := makeError(arg0, args)
+	Global.intLogf(ctx, lvl, "%s", err.Error())
+	return err
+}
+
+// Utility for error log messages carrying the fields and trace of ctx (returns an error for easy function returns) (see Debug() for parameter explanation)
+// These functions will execute a closure exactly once, to build the error message for the return
+// Wrapper for (*Logger).ErrorCtx
+func ErrorCtx(ctx context.Context, arg0 interface{}, args ...interface{}) error {
+	const (
+		lvl = ERROR
+	)
+	err := makeError(arg0, args)
+	Global.intLogf(ctx, lvl, "%s", err.Error())
+	return err
+}
+
+// Utility for critical log messages carrying the fields and trace of ctx (returns an error for easy function returns) (see Debug() for parameter explanation)
+// These functions will execute a closure exactly once, to build the error message for the return
+// Wrapper for (*Logger).CriticalCtx
+func CriticalCtx(ctx context.Context, arg0 interface{}, args ...interface{}) error {
+	const (
+		lvl = CRITICAL
+	)
+	err := makeError(arg0, args)
+	Global.intLogf(ctx, lvl, "%s", err.Error())
+	return err
 }